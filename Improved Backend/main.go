@@ -1,539 +1,8203 @@
-package main
-
-import (
-	"database/sql"
-	"encoding/csv"
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"os"
-	"time"
-
-	_ "github.com/mattn/go-sqlite3"
-)
-
-// SensorData represents the data structure from BME680 sensor
-type SensorData struct {
-	Temperature   float64 `json:"temperature"`
-	Humidity      float64 `json:"humidity"`
-	Pressure      float64 `json:"pressure"`
-	GasResistance *int    `json:"gas_resistance,omitempty"` // BME680 specific
-	AQI           *int    `json:"aqi,omitempty"`            // Air Quality Index
-}
-
-// DateQuery represents a date query for IST timezone
-type DateQuery struct {
-	Day   int `json:"day"`
-	Month int `json:"month"`
-	Year  int `json:"year"`
-}
-
-// DateRangeQuery represents a date range query
-type DateRangeQuery struct {
-	StartDate string `json:"startDate"`
-	EndDate   string `json:"endDate"`
-}
-
-// DatabaseRecord represents a record from the database
-type DatabaseRecord struct {
-	ID            int       `json:"id"`
-	Temperature   float64   `json:"temperature"`
-	Humidity      float64   `json:"humidity"`
-	Pressure      float64   `json:"pressure"`
-	GasResistance *int      `json:"gas_resistance,omitempty"` // Nullable
-	Timestamp     time.Time `json:"timestamp"`
-}
-
-func main() {
-	// Open database connection
-	db, err := sql.Open("sqlite3", "./data.db")
-	if err != nil {
-		log.Fatal("Failed to open database:", err)
-	}
-	defer db.Close()
-
-	// Test database connection
-	if err := db.Ping(); err != nil {
-		log.Fatal("Failed to ping database:", err)
-	}
-
-	// Create table if not exists (with gas_resistance and aqi columns for BME680)
-	createTableSQL := `CREATE TABLE IF NOT EXISTS temp (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		temperature REAL NOT NULL,
-		humidity REAL NOT NULL,
-		pressure REAL NOT NULL,
-		gas_resistance INTEGER,
-		aqi INTEGER,
-		timestamp DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatal("Failed to create table:", err)
-	}
-
-	// Check and add gas_resistance column if it doesn't exist (for migration from old schema)
-	// SQLite doesn't support IF NOT EXISTS for ALTER TABLE, so we check first
-	var gasResistanceExists bool
-	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('temp') WHERE name='gas_resistance'`).Scan(&gasResistanceExists)
-	if err == nil && !gasResistanceExists {
-		_, err = db.Exec(`ALTER TABLE temp ADD COLUMN gas_resistance INTEGER;`)
-		if err != nil {
-			log.Printf("Warning: Failed to add gas_resistance column: %v", err)
-		} else {
-			log.Println("Added gas_resistance column to existing table")
-		}
-	}
-
-	// Check and add aqi column if it doesn't exist
-	var aqiExists bool
-	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('temp') WHERE name='aqi'`).Scan(&aqiExists)
-	if err == nil && !aqiExists {
-		_, err = db.Exec(`ALTER TABLE temp ADD COLUMN aqi INTEGER;`)
-		if err != nil {
-			log.Printf("Warning: Failed to add aqi column: %v", err)
-		} else {
-			log.Println("Added aqi column to existing table")
-		}
-	}
-
-	log.Println("Database schema verified and ready")
-
-	// Create index on timestamp for better query performance
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_timestamp ON temp(timestamp);`)
-	if err != nil {
-		log.Println("Warning: Failed to create index:", err)
-	}
-
-	// Serve static files
-	fs := http.FileServer(http.Dir("."))
-	http.Handle("/", fs)
-
-	// API: Record sensor data
-	http.HandleFunc("/temprec", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		var data SensorData
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
-			return
-		}
-
-		// Validate data ranges
-		if data.Temperature < -50 || data.Temperature > 100 {
-			http.Error(w, "Temperature out of valid range (-50 to 100°C)", http.StatusBadRequest)
-			return
-		}
-		if data.Humidity < 0 || data.Humidity > 100 {
-			http.Error(w, "Humidity out of valid range (0 to 100%)", http.StatusBadRequest)
-			return
-		}
-		if data.Pressure < 300 || data.Pressure > 1100 {
-			http.Error(w, "Pressure out of valid range (300 to 1100 hPa)", http.StatusBadRequest)
-			return
-		}
-
-		// Store current time in UTC
-		utc := time.Now().UTC()
-
-		// Insert data into database
-		var gasResistance *int
-		if data.GasResistance != nil && *data.GasResistance > 0 {
-			gasResistance = data.GasResistance
-		}
-
-		sqlStmt := `INSERT INTO temp (temperature, humidity, pressure, gas_resistance, aqi, timestamp) VALUES (?, ?, ?, ?, ?, ?)`
-		_, err := db.Exec(sqlStmt, data.Temperature, data.Humidity, data.Pressure, gasResistance, data.AQI, utc.Format(time.RFC3339))
-		if err != nil {
-			log.Printf("Database error: %v", err)
-			http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		aqiStr := "N/A"
-		if data.AQI != nil {
-			aqiStr = fmt.Sprintf("%d", *data.AQI)
-		}
-		log.Printf("Data recorded: Temp=%.2f°C, Hum=%.2f%%, Pres=%.2fhPa, Gas=%v, AQI=%s",
-			data.Temperature, data.Humidity, data.Pressure, gasResistance, aqiStr)
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": "Data recorded successfully"})
-	})
-
-	// API: Get latest reading
-	http.HandleFunc("/temp", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		sqlStmt := `SELECT id, temperature, humidity, pressure, gas_resistance, aqi, timestamp FROM temp ORDER BY id DESC LIMIT 1`
-		row := db.QueryRow(sqlStmt)
-
-		var id int
-		var temperature, humidity, pressure float64
-		var gasResistance, aqi sql.NullInt64
-		var timestampStr string
-
-		err := row.Scan(&id, &temperature, &humidity, &pressure, &gasResistance, &aqi, &timestampStr)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "No data available", http.StatusNotFound)
-				return
-			}
-			log.Printf("Database error: %v", err)
-			http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		// Parse timestamp
-		timestamp, err := time.Parse(time.RFC3339, timestampStr)
-		if err != nil {
-			log.Printf("Timestamp parse error: %v", err)
-			http.Error(w, "Invalid timestamp format", http.StatusInternalServerError)
-			return
-		}
-
-		results := map[string]interface{}{
-			"temperature": temperature,
-			"humidity":    humidity,
-			"pressure":    pressure,
-			"timestamp":   timestamp.Format(time.RFC3339),
-		}
-
-		if gasResistance.Valid {
-			results["gas_resistance"] = gasResistance.Int64
-		}
-
-		if aqi.Valid {
-			results["aqi"] = aqi.Int64
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(results)
-	})
-
-	// API: Get daily statistics (IST timezone)
-	http.HandleFunc("/tempstat", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		var dateQuery DateQuery
-		if err := json.NewDecoder(r.Body).Decode(&dateQuery); err != nil {
-			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
-			return
-		}
-
-		// Validate date
-		if dateQuery.Day < 1 || dateQuery.Day > 31 || dateQuery.Month < 1 || dateQuery.Month > 12 || dateQuery.Year < 2000 {
-			http.Error(w, "Invalid date", http.StatusBadRequest)
-			return
-		}
-
-		// Create IST location (UTC+5:30)
-		istLocation := time.FixedZone("IST", 5*60*60+30*60)
-
-		// Create start and end of day in IST
-		istStart := time.Date(dateQuery.Year, time.Month(dateQuery.Month), dateQuery.Day, 0, 0, 0, 0, istLocation)
-		istEnd := istStart.Add(24 * time.Hour)
-
-		// Convert to UTC for database query
-		utcStart := istStart.UTC()
-		utcEnd := istEnd.UTC()
-
-		sqlStmt := `
-			SELECT 
-				MAX(temperature), MIN(temperature), AVG(temperature),
-				MAX(humidity), MIN(humidity), AVG(humidity),
-				MAX(pressure), MIN(pressure), AVG(pressure),
-				MAX(gas_resistance), MIN(gas_resistance), AVG(gas_resistance),
-				MAX(aqi), MIN(aqi), AVG(aqi)
-			FROM temp 
-			WHERE timestamp >= ? AND timestamp < ?`
-
-		row := db.QueryRow(sqlStmt, utcStart.Format(time.RFC3339), utcEnd.Format(time.RFC3339))
-
-		var maxTemp, minTemp, avgTemp sql.NullFloat64
-		var maxHum, minHum, avgHum sql.NullFloat64
-		var maxPres, minPres, avgPres sql.NullFloat64
-		var maxGas, minGas sql.NullInt64
-		var avgGas sql.NullFloat64
-		var maxAQI, minAQI sql.NullInt64
-		var avgAQI sql.NullFloat64
-
-		err := row.Scan(&maxTemp, &minTemp, &avgTemp, &maxHum, &minHum, &avgHum,
-			&maxPres, &minPres, &avgPres, &maxGas, &minGas, &avgGas,
-			&maxAQI, &minAQI, &avgAQI)
-
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "No data available for the specified date", http.StatusNotFound)
-				return
-			}
-			log.Printf("Database error: %v", err)
-			http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		results := make(map[string]interface{})
-
-		if maxTemp.Valid {
-			results["max_temperature"] = maxTemp.Float64
-			results["min_temperature"] = minTemp.Float64
-			results["avg_temperature"] = avgTemp.Float64
-		}
-		if maxHum.Valid {
-			results["max_humidity"] = maxHum.Float64
-			results["min_humidity"] = minHum.Float64
-			results["avg_humidity"] = avgHum.Float64
-		}
-		if maxPres.Valid {
-			results["max_pressure"] = maxPres.Float64
-			results["min_pressure"] = minPres.Float64
-			results["avg_pressure"] = avgPres.Float64
-		}
-		if maxGas.Valid {
-			results["max_gas_resistance"] = maxGas.Int64
-			results["min_gas_resistance"] = minGas.Int64
-			if avgGas.Valid {
-				results["avg_gas_resistance"] = avgGas.Float64
-			}
-		}
-		if maxAQI.Valid {
-			results["max_aqi"] = maxAQI.Int64
-			results["min_aqi"] = minAQI.Int64
-			if avgAQI.Valid {
-				results["avg_aqi"] = avgAQI.Float64
-			}
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(results)
-	})
-
-	// API: Get daily data as CSV
-	http.HandleFunc("/tempget", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		var dateQuery DateQuery
-		if err := json.NewDecoder(r.Body).Decode(&dateQuery); err != nil {
-			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
-			return
-		}
-
-		// Create IST location
-		istLocation := time.FixedZone("IST", 5*60*60+30*60)
-		istStart := time.Date(dateQuery.Year, time.Month(dateQuery.Month), dateQuery.Day, 0, 0, 0, 0, istLocation)
-		istEnd := istStart.Add(24 * time.Hour)
-		utcStart := istStart.UTC()
-		utcEnd := istEnd.UTC()
-
-		sqlStmt := `
-			SELECT temperature, humidity, pressure, gas_resistance, aqi, timestamp 
-			FROM temp 
-			WHERE timestamp >= ? AND timestamp < ?
-			ORDER BY timestamp ASC`
-
-		rows, err := db.Query(sqlStmt, utcStart.Format(time.RFC3339), utcEnd.Format(time.RFC3339))
-		if err != nil {
-			log.Printf("Database error: %v", err)
-			http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		w.Header().Set("Content-Type", "text/csv")
-		w.Header().Set("Content-Disposition", "attachment; filename=weather_data.csv")
-
-		writer := csv.NewWriter(w)
-		defer writer.Flush()
-
-		// Write CSV header
-		header := []string{"Temperature", "Humidity", "Pressure", "Gas_Resistance", "AQI", "Timestamp"}
-		if err := writer.Write(header); err != nil {
-			return
-		}
-
-		// Write data rows
-		for rows.Next() {
-			var temperature, humidity, pressure float64
-			var gasResistance, aqi sql.NullInt64
-			var timestampStr string
-
-			if err := rows.Scan(&temperature, &humidity, &pressure, &gasResistance, &aqi, &timestampStr); err != nil {
-				log.Printf("Row scan error: %v", err)
-				continue
-			}
-
-			// Parse and convert timestamp to IST for display
-			timestamp, err := time.Parse(time.RFC3339, timestampStr)
-			if err != nil {
-				log.Printf("Timestamp parse error: %v", err)
-				continue
-			}
-
-			istLocation := time.FixedZone("IST", 5*60*60+30*60)
-			istTime := timestamp.In(istLocation)
-
-			gasStr := ""
-			if gasResistance.Valid {
-				gasStr = fmt.Sprintf("%d", gasResistance.Int64)
-			}
-
-			aqiStr := ""
-			if aqi.Valid {
-				aqiStr = fmt.Sprintf("%d", aqi.Int64)
-			}
-
-			record := []string{
-				fmt.Sprintf("%.2f", temperature),
-				fmt.Sprintf("%.2f", humidity),
-				fmt.Sprintf("%.2f", pressure),
-				gasStr,
-				aqiStr,
-				istTime.Format("2006-01-02 15:04:05 IST"),
-			}
-			if err := writer.Write(record); err != nil {
-				log.Printf("CSV write error: %v", err)
-			}
-		}
-	})
-
-	// API: Get date range data
-	http.HandleFunc("/tempdaterange", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-			return
-		}
-
-		var dateRange DateRangeQuery
-		if err := json.NewDecoder(r.Body).Decode(&dateRange); err != nil {
-			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
-			return
-		}
-
-		// Parse the input dates (expecting RFC3339 format)
-		startDate, err := time.Parse(time.RFC3339, dateRange.StartDate)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid start date format: %v. Expected RFC3339 format (e.g., 2024-01-15T00:00:00Z)", err), http.StatusBadRequest)
-			return
-		}
-		endDate, err := time.Parse(time.RFC3339, dateRange.EndDate)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid end date format: %v. Expected RFC3339 format (e.g., 2024-01-15T23:59:59Z)", err), http.StatusBadRequest)
-			return
-		}
-
-		if endDate.Before(startDate) {
-			http.Error(w, "End date must be after start date", http.StatusBadRequest)
-			return
-		}
-
-		// Log the query parameters
-		log.Printf("Date range query: Start=%v (UTC), End=%v (UTC), Span=%.2f days",
-			startDate.Format(time.RFC3339),
-			endDate.Format(time.RFC3339),
-			endDate.Sub(startDate).Hours()/24)
-
-		// Query data for the specified date range
-		// Use >= and <= to include both start and end dates
-		sqlStmt := `
-			SELECT temperature, humidity, pressure, gas_resistance, aqi, timestamp 
-			FROM temp 
-			WHERE timestamp >= ? AND timestamp <= ?
-			ORDER BY timestamp ASC`
-
-		rows, err := db.Query(sqlStmt, startDate.Format(time.RFC3339), endDate.Format(time.RFC3339))
-		if err != nil {
-			log.Printf("Database error: %v", err)
-			http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var results []map[string]interface{}
-		rowCount := 0
-		for rows.Next() {
-			var temperature, humidity, pressure float64
-			var gasResistance, aqi sql.NullInt64
-			var timestampStr string
-
-			if err := rows.Scan(&temperature, &humidity, &pressure, &gasResistance, &aqi, &timestampStr); err != nil {
-				log.Printf("Row scan error: %v", err)
-				continue
-			}
-
-			// Parse timestamp
-			timestamp, err := time.Parse(time.RFC3339, timestampStr)
-			if err != nil {
-				log.Printf("Timestamp parse error: %v", err)
-				continue
-			}
-
-			result := map[string]interface{}{
-				"temperature": temperature,
-				"humidity":    humidity,
-				"pressure":    pressure,
-				"timestamp":   timestamp.Format(time.RFC3339),
-			}
-
-			if gasResistance.Valid {
-				result["gas_resistance"] = gasResistance.Int64
-			}
-
-			if aqi.Valid {
-				result["aqi"] = aqi.Int64
-			}
-
-			results = append(results, result)
-			rowCount++
-		}
-
-		if err = rows.Err(); err != nil {
-			log.Printf("Rows error: %v", err)
-			http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		log.Printf("Date range query returned %d rows", rowCount)
-		if rowCount > 0 {
-			firstTimestamp, _ := time.Parse(time.RFC3339, results[0]["timestamp"].(string))
-			lastTimestamp, _ := time.Parse(time.RFC3339, results[len(results)-1]["timestamp"].(string))
-			log.Printf("  First record: %v (UTC)", firstTimestamp.Format(time.RFC3339))
-			log.Printf("  Last record: %v (UTC)", lastTimestamp.Format(time.RFC3339))
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(results)
-	})
-
-	// Health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "healthy",
-			"time":   time.Now().UTC().Format(time.RFC3339),
-		})
-	})
-
-	// Get server port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8811"
-	}
-
-	log.Printf("Server starting on port %s...", port)
-	log.Printf("Health check: http://localhost:%s/health", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
-}
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	_ "embed"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/parquet-go/parquet-go"
+)
+
+// openAPISpec is the hand-maintained OpenAPI 3 description of the endpoints below
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Build metadata, injected at build time with
+// -ldflags "-X main.version=1.2.0 -X main.commit=abc123 -X main.buildTime=2024-03-15T10:00:00Z"
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildTime = "dev"
+)
+
+// SensorData represents the data structure from BME680 sensor
+type SensorData struct {
+	Temperature   float64  `json:"temperature"`
+	Humidity      float64  `json:"humidity"`
+	Pressure      float64  `json:"pressure"`
+	GasResistance *int     `json:"gas_resistance,omitempty"` // BME680 specific
+	AQI           *int     `json:"aqi,omitempty"`            // Air Quality Index
+	TempUnit      string   `json:"temp_unit,omitempty"`      // "C" (default) or "F"
+	PressureUnit  string   `json:"pressure_unit,omitempty"`  // "hPa" (default) or "inHg"
+	Location      *string  `json:"location,omitempty"`       // Sensor location name
+	Timestamp     string   `json:"timestamp,omitempty"`      // Original reading time (RFC3339), defaults to server time
+	WindSpeed     *float64 `json:"wind_speed,omitempty"`     // Anemometer, m/s
+	WindDirection *float64 `json:"wind_direction,omitempty"` // Weather vane, degrees clockwise from north
+	Rainfall      *float64 `json:"rainfall,omitempty"`       // Rain gauge, mm since the previous reading
+	Warmup        bool     `json:"warmup,omitempty"`         // Taken while the sensor was still warming up
+	Note          string   `json:"note,omitempty"`           // Free-text annotation, e.g. "opened window"
+	Altitude      *float64 `json:"altitude,omitempty"`       // Station height above sea level in meters, defaults to STATION_ALTITUDE
+}
+
+// maxNoteLength is the longest note, in characters, accepted on a reading
+const maxNoteLength = 500
+
+// nullableNote stores an empty note as NULL, so only annotated rows carry one
+func nullableNote(note string) interface{} {
+	if note == "" {
+		return nil
+	}
+	return note
+}
+
+// hPaPerInHg is the number of hectopascals in one inch of mercury
+const hPaPerInHg = 33.8639
+
+// ValidationError describes a single invalid request field
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// normalizeUnits converts temperature and pressure to canonical Celsius/hPa
+func (d *SensorData) normalizeUnits() []ValidationError {
+	var errs []ValidationError
+
+	switch d.TempUnit {
+	case "", "C", "c":
+	case "F", "f":
+		d.Temperature = (d.Temperature - 32) * 5 / 9
+	default:
+		errs = append(errs, ValidationError{"temp_unit", fmt.Sprintf("invalid temp_unit %q (expected C or F)", d.TempUnit)})
+	}
+
+	switch d.PressureUnit {
+	case "", "hPa", "hpa":
+	case "inHg", "inhg":
+		d.Pressure = d.Pressure * hPaPerInHg
+	default:
+		errs = append(errs, ValidationError{"pressure_unit", fmt.Sprintf("invalid pressure_unit %q (expected hPa or inHg)", d.PressureUnit)})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	d.TempUnit = "C"
+	d.PressureUnit = "hPa"
+	return nil
+}
+
+// readingTime returns the UTC time to store for d: the client-supplied timestamp
+// when present, otherwise now. Timestamps more than maxSkew after now are rejected.
+func (d *SensorData) readingTime(now time.Time, maxSkew time.Duration) (time.Time, []ValidationError) {
+	if d.Timestamp == "" {
+		return now.UTC(), nil
+	}
+	ts, err := time.Parse(time.RFC3339, d.Timestamp)
+	if err != nil {
+		return time.Time{}, []ValidationError{{"timestamp", fmt.Sprintf("invalid timestamp %q (expected RFC3339)", d.Timestamp)}}
+	}
+	if ts.After(now.Add(maxSkew)) {
+		return time.Time{}, []ValidationError{{"timestamp", fmt.Sprintf("timestamp is more than %v in the future", maxSkew)}}
+	}
+	return ts.UTC(), nil
+}
+
+// validate checks every field of d against its range and returns all failures
+func (d *SensorData) validate(ranges ValidationRanges) []ValidationError {
+	var errs []ValidationError
+	if err := ranges.checkTemperature(d.Temperature); err != nil {
+		errs = append(errs, ValidationError{"temperature", err.Error()})
+	}
+	if err := ranges.checkHumidity(d.Humidity); err != nil {
+		errs = append(errs, ValidationError{"humidity", err.Error()})
+	}
+	if err := ranges.checkPressure(d.Pressure); err != nil {
+		errs = append(errs, ValidationError{"pressure", err.Error()})
+	}
+	if d.GasResistance != nil {
+		if err := ranges.checkGasResistance(*d.GasResistance); err != nil {
+			errs = append(errs, ValidationError{"gas_resistance", err.Error()})
+		}
+	}
+	if d.AQI != nil {
+		if err := checkAQI(*d.AQI); err != nil {
+			errs = append(errs, ValidationError{"aqi", err.Error()})
+		}
+	}
+	if d.WindSpeed != nil {
+		if err := ranges.checkWindSpeed(*d.WindSpeed); err != nil {
+			errs = append(errs, ValidationError{"wind_speed", err.Error()})
+		}
+	}
+	if d.WindDirection != nil && (*d.WindDirection < 0 || *d.WindDirection > 360) {
+		errs = append(errs, ValidationError{"wind_direction", "Wind direction out of valid range (0 to 360 degrees)"})
+	}
+	if d.Rainfall != nil {
+		if err := ranges.checkRainfall(*d.Rainfall); err != nil {
+			errs = append(errs, ValidationError{"rainfall", err.Error()})
+		}
+	}
+	if d.Altitude != nil && (*d.Altitude < -500 || *d.Altitude > 9000) {
+		errs = append(errs, ValidationError{"altitude", "Altitude out of valid range (-500 to 9000 m)"})
+	}
+	if n := utf8.RuneCountInString(d.Note); n > maxNoteLength {
+		errs = append(errs, ValidationError{"note", fmt.Sprintf("note is %d characters long (maximum %d)", n, maxNoteLength)})
+	}
+	return errs
+}
+
+// Calibration holds per-metric offsets added to incoming readings after unit
+// conversion, in Celsius, percent and hPa
+type Calibration struct {
+	Temperature float64 `json:"temperature"`
+	Humidity    float64 `json:"humidity"`
+	Pressure    float64 `json:"pressure"`
+}
+
+// apply adds the calibration offsets to d
+func (c Calibration) apply(d *SensorData) {
+	d.Temperature += c.Temperature
+	d.Humidity += c.Humidity
+	d.Pressure += c.Pressure
+}
+
+// ReadingPatch represents a partial update to a stored reading
+type ReadingPatch struct {
+	Temperature   *float64 `json:"temperature"`
+	Humidity      *float64 `json:"humidity"`
+	Pressure      *float64 `json:"pressure"`
+	GasResistance *int     `json:"gas_resistance"`
+	AQI           *int     `json:"aqi"`
+}
+
+// validate checks the fields present in p against their ranges and returns
+// all failures, as SensorData.validate does for a whole reading
+func (p ReadingPatch) validate(ranges ValidationRanges) []ValidationError {
+	var errs []ValidationError
+	if p.Temperature != nil {
+		if err := ranges.checkTemperature(*p.Temperature); err != nil {
+			errs = append(errs, ValidationError{"temperature", err.Error()})
+		}
+	}
+	if p.Humidity != nil {
+		if err := ranges.checkHumidity(*p.Humidity); err != nil {
+			errs = append(errs, ValidationError{"humidity", err.Error()})
+		}
+	}
+	if p.Pressure != nil {
+		if err := ranges.checkPressure(*p.Pressure); err != nil {
+			errs = append(errs, ValidationError{"pressure", err.Error()})
+		}
+	}
+	if p.GasResistance != nil {
+		if err := ranges.checkGasResistance(*p.GasResistance); err != nil {
+			errs = append(errs, ValidationError{"gas_resistance", err.Error()})
+		}
+	}
+	if p.AQI != nil {
+		if err := checkAQI(*p.AQI); err != nil {
+			errs = append(errs, ValidationError{"aqi", err.Error()})
+		}
+	}
+	return errs
+}
+
+// ValidationRanges holds the accepted bounds for sensor readings
+type ValidationRanges struct {
+	TempMin      float64 `json:"temp_min"`
+	TempMax      float64 `json:"temp_max"`
+	HumidityMin  float64 `json:"humidity_min"`
+	HumidityMax  float64 `json:"humidity_max"`
+	PressureMin  float64 `json:"pressure_min"`
+	PressureMax  float64 `json:"pressure_max"`
+	GasMin       int     `json:"gas_min"`
+	GasMax       int     `json:"gas_max"`
+	WindSpeedMax float64 `json:"wind_speed_max"`
+	RainfallMax  float64 `json:"rainfall_max"`
+}
+
+// checkTemperature checks a temperature in °C against the accepted range
+func (v ValidationRanges) checkTemperature(t float64) error {
+	if t < v.TempMin || t > v.TempMax {
+		return fmt.Errorf("Temperature out of valid range (%g to %g°C)", v.TempMin, v.TempMax)
+	}
+	return nil
+}
+
+// checkHumidity checks a relative humidity in % against the accepted range
+func (v ValidationRanges) checkHumidity(h float64) error {
+	if h < v.HumidityMin || h > v.HumidityMax {
+		return fmt.Errorf("Humidity out of valid range (%g to %g%%)", v.HumidityMin, v.HumidityMax)
+	}
+	return nil
+}
+
+// checkPressure checks a pressure in hPa against the accepted range
+func (v ValidationRanges) checkPressure(p float64) error {
+	if p < v.PressureMin || p > v.PressureMax {
+		return fmt.Errorf("Pressure out of valid range (%g to %g hPa)", v.PressureMin, v.PressureMax)
+	}
+	return nil
+}
+
+// checkGasResistance checks a gas resistance in ohms against the accepted range
+func (v ValidationRanges) checkGasResistance(g int) error {
+	if g < v.GasMin || g > v.GasMax {
+		return fmt.Errorf("Gas resistance out of valid range (%d to %d ohms)", v.GasMin, v.GasMax)
+	}
+	return nil
+}
+
+// checkWindSpeed checks a wind speed in m/s against the accepted range
+func (v ValidationRanges) checkWindSpeed(s float64) error {
+	if s < 0 || s > v.WindSpeedMax {
+		return fmt.Errorf("Wind speed out of valid range (0 to %g m/s)", v.WindSpeedMax)
+	}
+	return nil
+}
+
+// checkRainfall checks a per-reading rainfall in mm against the accepted range
+func (v ValidationRanges) checkRainfall(r float64) error {
+	if r < 0 || r > v.RainfallMax {
+		return fmt.Errorf("Rainfall out of valid range (0 to %g mm)", v.RainfallMax)
+	}
+	return nil
+}
+
+// readingClamp pulls temperature and humidity that fall just outside the
+// accepted range back to the boundary instead of rejecting the reading, so
+// sensor rounding such as 100.3% humidity does not drop a good sample
+type readingClamp struct {
+	enabled           bool
+	tempTolerance     float64 // °C beyond TempMin/TempMax that is clamped
+	humidityTolerance float64 // percentage points beyond HumidityMin/HumidityMax that is clamped
+}
+
+// clampValue returns v moved onto [min, max] when it lies within tol of it
+func clampValue(v, min, max, tol float64) (float64, bool) {
+	switch {
+	case v > max && v <= max+tol:
+		return max, true
+	case v < min && v >= min-tol:
+		return min, true
+	}
+	return v, false
+}
+
+// apply clamps d's temperature and humidity against ranges and describes
+// each change; values further out are left for validation to reject
+func (c readingClamp) apply(d *SensorData, ranges ValidationRanges) []string {
+	if !c.enabled {
+		return nil
+	}
+	var clamped []string
+	if v, ok := clampValue(d.Temperature, ranges.TempMin, ranges.TempMax, c.tempTolerance); ok {
+		clamped = append(clamped, fmt.Sprintf("temperature %g -> %g", d.Temperature, v))
+		d.Temperature = v
+	}
+	if v, ok := clampValue(d.Humidity, ranges.HumidityMin, ranges.HumidityMax, c.humidityTolerance); ok {
+		clamped = append(clamped, fmt.Sprintf("humidity %g -> %g", d.Humidity, v))
+		d.Humidity = v
+	}
+	return clamped
+}
+
+// Config holds server settings, loaded from an optional JSON file and overridden by env vars
+type Config struct {
+	Port            string           `json:"port"`
+	ListenAddr      string           `json:"listen_addr,omitempty"`
+	DBPath          string           `json:"db_path"`
+	Timezone        string           `json:"timezone,omitempty"`
+	TZOffsetMinutes *int             `json:"tz_offset_minutes,omitempty"`
+	Validation      ValidationRanges `json:"validation"`
+	RoundDecimals   int              `json:"round_decimals"`
+	StationAltitude *float64         `json:"station_altitude,omitempty"` // meters, used for readings that carry no altitude
+
+	// TenantKeys maps API keys to the location their holder may read and write
+	TenantKeys map[string]string `json:"tenant_keys,omitempty"`
+
+	// LocationValidation overrides validation bounds per location name. Each
+	// entry only needs the bounds it changes; the rest come from Validation.
+	LocationValidation map[string]json.RawMessage `json:"location_validation,omitempty"`
+	locationRanges     map[string]ValidationRanges
+
+	// localZone is the timezone resolved from TZOffsetMinutes or Timezone
+	localZone *time.Location
+}
+
+// rangesFor returns the validation bounds for readings from location
+func (c Config) rangesFor(location string) ValidationRanges {
+	if ranges, ok := c.locationRanges[location]; ok {
+		return ranges
+	}
+	return c.Validation
+}
+
+// defaultConfig returns the settings used when neither file nor env provide a value
+func defaultConfig() Config {
+	return Config{
+		Port:          "8811",
+		DBPath:        "./data.db",
+		RoundDecimals: 2,
+		Validation: ValidationRanges{
+			TempMin:      -50,
+			TempMax:      100,
+			HumidityMin:  0,
+			HumidityMax:  100,
+			PressureMin:  300,
+			PressureMax:  1100,
+			GasMin:       0,
+			GasMax:       2000000,
+			WindSpeedMax: 100,
+			RainfallMax:  500,
+		},
+	}
+}
+
+// loadConfig builds the configuration from defaults, then the JSON file named by
+// CONFIG_FILE (default ./config.json, skipped if absent), then env vars, which
+// take precedence over file values.
+func loadConfig() (Config, error) {
+	cfg := defaultConfig()
+
+	path := os.Getenv("CONFIG_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = "config.json"
+	}
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+		f.Close()
+		if err != nil {
+			return cfg, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		log.Printf("Loaded config file %s", path)
+	case explicit || !os.IsNotExist(err):
+		return cfg, err
+	}
+
+	if v := os.Getenv("PORT"); v != "" {
+		cfg.Port = v
+	}
+	if v := os.Getenv("LISTEN_ADDR"); v != "" {
+		cfg.ListenAddr = v
+	}
+	if v := os.Getenv("DB_PATH"); v != "" {
+		cfg.DBPath = v
+	}
+	if v := os.Getenv("TIMEZONE"); v != "" {
+		cfg.Timezone = v
+	}
+	if v := os.Getenv("TZ_OFFSET_MINUTES"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid TZ_OFFSET_MINUTES %q: %w", v, err)
+		}
+		cfg.TZOffsetMinutes = &minutes
+	}
+	if cfg.localZone, err = loadTimezone(cfg); err != nil {
+		return cfg, err
+	}
+
+	ranges := &cfg.Validation
+	ranges.TempMin = envFloat("TEMP_MIN", ranges.TempMin)
+	ranges.TempMax = envFloat("TEMP_MAX", ranges.TempMax)
+	ranges.HumidityMin = envFloat("HUMIDITY_MIN", ranges.HumidityMin)
+	ranges.HumidityMax = envFloat("HUMIDITY_MAX", ranges.HumidityMax)
+	ranges.PressureMin = envFloat("PRESSURE_MIN", ranges.PressureMin)
+	ranges.PressureMax = envFloat("PRESSURE_MAX", ranges.PressureMax)
+	ranges.GasMin = envInt("GAS_MIN", ranges.GasMin)
+	ranges.GasMax = envInt("GAS_MAX", ranges.GasMax)
+	ranges.WindSpeedMax = envFloat("WIND_SPEED_MAX", ranges.WindSpeedMax)
+	ranges.RainfallMax = envFloat("RAINFALL_MAX", ranges.RainfallMax)
+
+	// Resolve per-location overrides on top of the final global bounds
+	cfg.locationRanges = make(map[string]ValidationRanges, len(cfg.LocationValidation))
+	for location, raw := range cfg.LocationValidation {
+		ranges := cfg.Validation
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&ranges); err != nil {
+			return cfg, fmt.Errorf("invalid location_validation for %q: %w", location, err)
+		}
+		cfg.locationRanges[location] = ranges
+	}
+
+	if v := os.Getenv("STATION_ALTITUDE"); v != "" {
+		altitude, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid STATION_ALTITUDE %q: %w", v, err)
+		}
+		cfg.StationAltitude = &altitude
+	}
+	if cfg.StationAltitude != nil && (*cfg.StationAltitude < -500 || *cfg.StationAltitude > 9000) {
+		return cfg, fmt.Errorf("invalid STATION_ALTITUDE %g: must be between -500 and 9000 meters", *cfg.StationAltitude)
+	}
+
+	// TENANT_KEYS replaces the file's keys, as key=location pairs
+	if v := os.Getenv("TENANT_KEYS"); v != "" {
+		cfg.TenantKeys = map[string]string{}
+		for _, pair := range strings.Split(v, ",") {
+			key, location, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			cfg.TenantKeys[key] = location
+		}
+	}
+	for key, location := range cfg.TenantKeys {
+		if key == "" || location == "" {
+			return cfg, fmt.Errorf("invalid tenant key: each entry needs a non-empty key and location")
+		}
+	}
+
+	cfg.RoundDecimals = envInt("ROUND_DECIMALS", cfg.RoundDecimals)
+	if cfg.RoundDecimals < 0 || cfg.RoundDecimals > 10 {
+		return cfg, fmt.Errorf("invalid ROUND_DECIMALS %d: must be between 0 and 10", cfg.RoundDecimals)
+	}
+
+	if !validPort(cfg.Port) {
+		return cfg, fmt.Errorf("invalid PORT %q: must be a number between 1 and 65535", cfg.Port)
+	}
+	if cfg.ListenAddr != "" {
+		_, listenPort, err := net.SplitHostPort(cfg.ListenAddr)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid LISTEN_ADDR %q: %w", cfg.ListenAddr, err)
+		}
+		if !validPort(listenPort) {
+			return cfg, fmt.Errorf("invalid LISTEN_ADDR %q: port %q must be a number between 1 and 65535", cfg.ListenAddr, listenPort)
+		}
+	}
+
+	return cfg, nil
+}
+
+// validPort reports whether s is a decimal TCP port between 1 and 65535
+func validPort(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= 1 && n <= 65535
+}
+
+// DateQuery represents a date query for the configured local timezone
+type DateQuery struct {
+	Day   int `json:"day"`
+	Month int `json:"month"`
+	Year  int `json:"year"`
+}
+
+// fieldHint describes the accepted values of a DateQuery field
+func (q DateQuery) fieldHint(field string) string {
+	switch field {
+	case "day":
+		return "an integer between 1 and 31"
+	case "month":
+		return "an integer between 1 and 12"
+	case "year":
+		return "an integer of 2000 or later"
+	}
+	return ""
+}
+
+// validate checks each field's range and that the day exists in the given month
+func (q DateQuery) validate() []ValidationError {
+	var errs []ValidationError
+	if q.Year < 2000 {
+		errs = append(errs, ValidationError{Field: "year", Message: "year must be " + q.fieldHint("year")})
+	}
+	if q.Month < 1 || q.Month > 12 {
+		errs = append(errs, ValidationError{Field: "month", Message: "month must be " + q.fieldHint("month")})
+	}
+	if q.Day < 1 || q.Day > 31 {
+		errs = append(errs, ValidationError{Field: "day", Message: "day must be " + q.fieldHint("day")})
+	} else if len(errs) == 0 {
+		// Day 0 of the next month is the last day of this one
+		last := time.Date(q.Year, time.Month(q.Month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+		if q.Day > last {
+			errs = append(errs, ValidationError{Field: "day", Message: fmt.Sprintf("day %d does not exist in %s %d (it has %d days)", q.Day, time.Month(q.Month), q.Year, last)})
+		}
+	}
+	return errs
+}
+
+// DateRangeQuery represents a date range query
+type DateRangeQuery struct {
+	StartDate string `json:"startDate"`
+	EndDate   string `json:"endDate"`
+	Smooth    int    `json:"smooth,omitempty"` // Centered moving-average window size (0 = raw)
+
+	FlagAnomalies    bool    `json:"flag_anomalies,omitempty"`    // Mark rows deviating from the rolling mean
+	AnomalyThreshold float64 `json:"anomaly_threshold,omitempty"` // Standard deviations (default ANOMALY_STDDEV)
+	AnomalyWindow    int     `json:"anomaly_window,omitempty"`    // Preceding rows in the rolling window (default ANOMALY_WINDOW)
+
+	// Optional inclusive value bounds; rows with a null value are skipped
+	AQIMin         *float64 `json:"aqi_min,omitempty"`
+	AQIMax         *float64 `json:"aqi_max,omitempty"`
+	TemperatureMin *float64 `json:"temperature_min,omitempty"`
+	TemperatureMax *float64 `json:"temperature_max,omitempty"`
+	HumidityMin    *float64 `json:"humidity_min,omitempty"`
+	HumidityMax    *float64 `json:"humidity_max,omitempty"`
+}
+
+// valueFilters returns SQL conditions and args for the optional value bounds
+// of q, and a validation error for each pair whose minimum exceeds its maximum
+func (q DateRangeQuery) valueFilters() (conds []string, args []interface{}, errs []ValidationError) {
+	for _, f := range []struct {
+		column   string
+		min, max *float64
+	}{
+		{"aqi", q.AQIMin, q.AQIMax},
+		{"temperature", q.TemperatureMin, q.TemperatureMax},
+		{"humidity", q.HumidityMin, q.HumidityMax},
+	} {
+		if f.min != nil && f.max != nil && *f.min > *f.max {
+			errs = append(errs, ValidationError{f.column + "_min", fmt.Sprintf("%s_min %g is greater than %s_max %g", f.column, *f.min, f.column, *f.max)})
+			continue
+		}
+		if f.min != nil {
+			conds = append(conds, f.column+" >= ?")
+			args = append(args, *f.min)
+		}
+		if f.max != nil {
+			conds = append(conds, f.column+" <= ?")
+			args = append(args, *f.max)
+		}
+	}
+	return conds, args, errs
+}
+
+// HistogramQuery represents a value-distribution query over a date range
+type HistogramQuery struct {
+	DateRangeQuery
+	Metric  string   `json:"metric"`
+	Buckets int      `json:"buckets"`
+	Min     *float64 `json:"min,omitempty"` // Optional explicit lower bound
+	Max     *float64 `json:"max,omitempty"` // Optional explicit upper bound
+}
+
+// CorrelationQuery pairs two metrics over a date range
+type CorrelationQuery struct {
+	DateRangeQuery
+	MetricX string `json:"metric_x"`
+	MetricY string `json:"metric_y"`
+}
+
+// GapQuery represents a data-continuity query over a date range
+type GapQuery struct {
+	DateRangeQuery
+	ExpectedInterval string  `json:"expected_interval"`
+	Factor           float64 `json:"factor,omitempty"` // Gap threshold as a multiple of the interval (default 1.5)
+}
+
+// CountsQuery represents a reading-count query over a date range
+type CountsQuery struct {
+	DateRangeQuery
+	GroupBy string `json:"group_by"` // "hour", "day" or "location"
+}
+
+// countBucketFormats are the strftime formats of the time groupings of /temp/counts
+var countBucketFormats = map[string]string{
+	"hour": "%Y-%m-%dT%H:00",
+	"day":  "%Y-%m-%d",
+}
+
+// metricColumns maps metric names accepted in queries to temp table columns
+var metricColumns = map[string]string{
+	"temperature":    "temperature",
+	"humidity":       "humidity",
+	"pressure":       "pressure",
+	"gas":            "gas_resistance",
+	"gas_resistance": "gas_resistance",
+	"aqi":            "aqi",
+}
+
+// DatabaseRecord represents a record from the database, as read by scanReading
+type DatabaseRecord struct {
+	ID            int       `json:"id"`
+	Temperature   float64   `json:"temperature"`
+	Humidity      float64   `json:"humidity"`
+	Pressure      float64   `json:"pressure"`
+	GasResistance *int      `json:"gas_resistance,omitempty"` // Nullable
+	AQI           *int      `json:"aqi,omitempty"`            // Nullable
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// recordColumns are the columns scanReading reads, in order. Queries may
+// select more columns after them and scan those through scanReading's extra.
+const recordColumns = `temperature, humidity, pressure, gas_resistance, aqi, timestamp`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanReading scans a row selected with recordColumns into a DatabaseRecord,
+// leaving GasResistance and AQI nil when null and parsing the timestamp.
+// Columns selected after recordColumns are scanned into extra.
+func scanReading(row rowScanner, extra ...interface{}) (DatabaseRecord, error) {
+	var rec DatabaseRecord
+	var gasResistance, aqi sql.NullInt64
+	var timestampStr string
+	dest := append([]interface{}{&rec.Temperature, &rec.Humidity, &rec.Pressure, &gasResistance, &aqi, &timestampStr}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return rec, err
+	}
+	if gasResistance.Valid {
+		g := int(gasResistance.Int64)
+		rec.GasResistance = &g
+	}
+	if aqi.Valid {
+		a := int(aqi.Int64)
+		rec.AQI = &a
+	}
+	timestamp, err := time.Parse(time.RFC3339, timestampStr)
+	if err != nil {
+		return rec, fmt.Errorf("invalid timestamp %q: %w", timestampStr, err)
+	}
+	rec.Timestamp = timestamp
+	return rec, nil
+}
+
+// result returns rec as a JSON response object; null gas_resistance and aqi
+// are omitted. Integers are int64, as smoothing and rounding expect.
+func (rec DatabaseRecord) result() map[string]interface{} {
+	result := map[string]interface{}{
+		"temperature": rec.Temperature,
+		"humidity":    rec.Humidity,
+		"pressure":    rec.Pressure,
+		"timestamp":   rec.Timestamp.Format(time.RFC3339),
+	}
+	if rec.GasResistance != nil {
+		result["gas_resistance"] = int64(*rec.GasResistance)
+	}
+	if rec.AQI != nil {
+		result["aqi"] = int64(*rec.AQI)
+	}
+	return result
+}
+
+// metric returns the named recordColumns metric as a float, or false when it
+// is null
+func (rec DatabaseRecord) metric(name string) (float64, bool) {
+	switch name {
+	case "temperature":
+		return rec.Temperature, true
+	case "humidity":
+		return rec.Humidity, true
+	case "pressure":
+		return rec.Pressure, true
+	case "gas_resistance":
+		if rec.GasResistance != nil {
+			return float64(*rec.GasResistance), true
+		}
+	case "aqi":
+		if rec.AQI != nil {
+			return float64(*rec.AQI), true
+		}
+	}
+	return 0, false
+}
+
+// aqiCategories maps AQI upper bounds to EPA-style category labels.
+// Entries must be sorted by Max; values above the last entry use its label.
+var aqiCategories = []struct {
+	Max   int
+	Label string
+}{
+	{50, "Good"},
+	{100, "Moderate"},
+	{150, "Unhealthy for Sensitive Groups"},
+	{200, "Unhealthy"},
+	{300, "Very Unhealthy"},
+	{500, "Hazardous"},
+}
+
+// checkAQI checks an AQI against the 0 to 500 scale of aqiCategories
+func checkAQI(aqi int) error {
+	if top := aqiCategories[len(aqiCategories)-1].Max; aqi < 0 || aqi > top {
+		return fmt.Errorf("AQI out of valid range (0 to %d)", top)
+	}
+	return nil
+}
+
+// aqiCategory returns the category label for an AQI value
+func aqiCategory(aqi int) string {
+	for _, c := range aqiCategories {
+		if aqi <= c.Max {
+			return c.Label
+		}
+	}
+	return aqiCategories[len(aqiCategories)-1].Label
+}
+
+// gasBaseline holds the rolling gas resistance baseline used for server-side AQI
+type gasBaseline struct {
+	mu        sync.RWMutex
+	value     int
+	updatedAt time.Time
+}
+
+func (b *gasBaseline) get() (int, time.Time) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.value, b.updatedAt
+}
+
+func (b *gasBaseline) set(value int, updatedAt time.Time) {
+	b.mu.Lock()
+	b.value = value
+	b.updatedAt = updatedAt
+	b.mu.Unlock()
+}
+
+// load restores the last persisted baseline from the baseline table
+func (b *gasBaseline) load(db *sql.DB) error {
+	var value int
+	var updatedStr string
+	err := db.QueryRow(`SELECT gas_resistance, updated_at FROM baseline WHERE id = 1`).Scan(&value, &updatedStr)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	updatedAt, err := time.Parse(time.RFC3339, updatedStr)
+	if err != nil {
+		return err
+	}
+	b.set(value, updatedAt)
+	return nil
+}
+
+// recompute sets the baseline to the maximum gas resistance seen within window
+// and persists it. The previous baseline is kept if the window has no gas data.
+func (b *gasBaseline) recompute(db *sql.DB, shards *shardStore, window time.Duration) error {
+	now := time.Now().UTC()
+	conn, table, release, err := shards.readConn(context.Background(), db, now.Add(-window), now)
+	if err != nil {
+		return err
+	}
+	var maxGas sql.NullInt64
+	err = conn.QueryRowContext(context.Background(), `SELECT MAX(gas_resistance) FROM `+table+` WHERE timestamp >= ?`,
+		now.Add(-window).Format(time.RFC3339)).Scan(&maxGas)
+	release()
+	if err != nil {
+		return err
+	}
+	if !maxGas.Valid {
+		return nil
+	}
+
+	_, err = db.Exec(`INSERT OR REPLACE INTO baseline (id, gas_resistance, updated_at) VALUES (1, ?, ?)`,
+		maxGas.Int64, now.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	b.set(int(maxGas.Int64), now)
+	return nil
+}
+
+// absoluteHumidity returns the water vapour density in g/m³ for a temperature
+// in °C and relative humidity in %. It uses the Magnus approximation of the
+// saturation vapour pressure, 6.112·e^(17.67·T/(T+243.5)) hPa, and the ideal
+// gas law for water vapour:
+//
+//	AH = 6.112 · e^(17.67·T/(T+243.5)) · RH · 2.1674 / (273.15 + T)
+//
+// The Magnus constants are fitted for water between -30°C and 35°C (within
+// about 0.1% there); outside that range the result is a rougher estimate.
+func absoluteHumidity(temp, relHumidity float64) float64 {
+	saturation := 6.112 * math.Exp(17.67*temp/(temp+243.5))
+	return saturation * relHumidity * 2.1674 / (273.15 + temp)
+}
+
+// seaLevelPressure reduces a station pressure in hPa, measured at altitude
+// meters with temperature in °C, to sea level with the hypsometric form of
+// the barometric formula:
+//
+//	P0 = P · (1 - 0.0065·h / (T + 0.0065·h + 273.15))^-5.257
+func seaLevelPressure(pressure, temp, altitude float64) float64 {
+	return pressure * math.Pow(1-0.0065*altitude/(temp+0.0065*altitude+273.15), -5.257)
+}
+
+// addSeaLevelPressure adds sea_level_pressure to result when the reading was
+// stored with an altitude; readings without one only report station pressure
+func addSeaLevelPressure(result map[string]interface{}, temp, pressure float64, altitude sql.NullFloat64, decimals int) {
+	if altitude.Valid {
+		result["sea_level_pressure"] = roundTo(seaLevelPressure(pressure, temp, altitude.Float64), decimals)
+	}
+}
+
+// dewPoint returns the dew point in °C for a temperature in °C and relative
+// humidity in %, inverting the same Magnus approximation as absoluteHumidity.
+// It returns false for non-positive humidity, where no dew point exists.
+func dewPoint(temp, relHumidity float64) (float64, bool) {
+	if relHumidity <= 0 {
+		return 0, false
+	}
+	gamma := math.Log(relHumidity/100) + 17.67*temp/(temp+243.5)
+	return 243.5 * gamma / (17.67 - gamma), true
+}
+
+// heatIndex returns the apparent temperature in °C for a temperature in °C and
+// relative humidity in %, using the NWS Rothfusz regression. Below a heat index
+// of about 80°F the regression is unreliable and Steadman's simpler formula is
+// used instead, as the NWS does.
+func heatIndex(temp, relHumidity float64) float64 {
+	t := temp*9/5 + 32
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + relHumidity*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*relHumidity - 0.22475541*t*relHumidity -
+			0.00683783*t*t - 0.05481717*relHumidity*relHumidity + 0.00122874*t*t*relHumidity +
+			0.00085282*t*relHumidity*relHumidity - 0.00000199*t*t*relHumidity*relHumidity
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// comfortBand is the comfortable range of one input to the comfort score.
+// Each unit outside [Min, Max] costs Penalty points, and the band costing the
+// most points names the reading with LowLabel or HighLabel.
+type comfortBand struct {
+	Metric    string
+	Min, Max  float64
+	Penalty   float64
+	LowLabel  string
+	HighLabel string
+}
+
+// comfortBands are the thresholds behind GET /temp/comfort
+var comfortBands = []comfortBand{
+	{Metric: "heat_index", Min: 20, Max: 26, Penalty: 10, LowLabel: "cold", HighLabel: "hot"},
+	{Metric: "humidity", Min: 30, Max: 60, Penalty: 2, LowLabel: "dry", HighLabel: "humid"},
+}
+
+// comfortScore scores values against comfortBands from 0 to 100 and returns
+// the label of the worst band, or "comfortable" when all are within range
+func comfortScore(values map[string]float64) (float64, string) {
+	score, label, worst := 100.0, "comfortable", 0.0
+	for _, b := range comfortBands {
+		v := values[b.Metric]
+		var penalty float64
+		bandLabel := ""
+		switch {
+		case v < b.Min:
+			penalty, bandLabel = (b.Min-v)*b.Penalty, b.LowLabel
+		case v > b.Max:
+			penalty, bandLabel = (v-b.Max)*b.Penalty, b.HighLabel
+		}
+		score -= penalty
+		if penalty > worst {
+			worst, label = penalty, bandLabel
+		}
+	}
+	return math.Max(score, 0), label
+}
+
+// computeAQI estimates an AQI (0-500) from gas resistance relative to the
+// clean-air baseline. Resistance at or above the baseline maps to 0; each 10%
+// drop below it adds 50. Returns false when no baseline is available yet.
+func computeAQI(gasResistance, baseline int) (int, bool) {
+	if baseline <= 0 || gasResistance <= 0 {
+		return 0, false
+	}
+	ratio := math.Min(float64(gasResistance)/float64(baseline), 1)
+	aqi := int(math.Round((1 - ratio) * 500))
+	return aqi, true
+}
+
+// envDuration reads a duration env var, falling back to def when unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: Invalid %s %q, using default %v", name, v, def)
+		return def
+	}
+	return d
+}
+
+// smoothedMetrics are the result keys smoothReadings averages
+var smoothedMetrics = []string{"temperature", "humidity", "pressure", "gas_resistance", "aqi"}
+
+// smoothReadings applies a centered moving average of the given window to each
+// metric in results, in place. Even windows are widened to the next odd size so
+// the window stays centered. At the start and end of the series the window is
+// truncated to the rows available, so edge values average fewer samples. Rows
+// where a metric is null stay null and are skipped when averaging neighbours.
+func smoothReadings(results []map[string]interface{}, window int) {
+	if window <= 1 {
+		return
+	}
+	half := window / 2
+	n := len(results)
+
+	for _, key := range smoothedMetrics {
+		raw := make([]float64, n)
+		present := make([]bool, n)
+		for i, r := range results {
+			switch v := r[key].(type) {
+			case float64:
+				raw[i], present[i] = v, true
+			case int64:
+				raw[i], present[i] = float64(v), true
+			}
+		}
+
+		for i := range results {
+			if !present[i] {
+				continue
+			}
+			sum, count := 0.0, 0
+			for j := i - half; j <= i+half; j++ {
+				if j < 0 || j >= n || !present[j] {
+					continue
+				}
+				sum += raw[j]
+				count++
+			}
+			results[i][key] = sum / float64(count)
+		}
+	}
+}
+
+// flagAnomalies sets an "anomaly" boolean on every row, true when any metric
+// deviates from the mean of the preceding window rows by more than threshold
+// standard deviations. Rows need at least two preceding values to be compared.
+func flagAnomalies(results []map[string]interface{}, window int, threshold float64) {
+	for i := range results {
+		results[i]["anomaly"] = false
+	}
+
+	for _, key := range smoothedMetrics {
+		values := make([]float64, len(results))
+		present := make([]bool, len(results))
+		for i, r := range results {
+			switch v := r[key].(type) {
+			case float64:
+				values[i], present[i] = v, true
+			case int64:
+				values[i], present[i] = float64(v), true
+			}
+		}
+
+		for i := range results {
+			if !present[i] {
+				continue
+			}
+			var sum, sumSq float64
+			count := 0
+			for j := i - window; j < i; j++ {
+				if j < 0 || !present[j] {
+					continue
+				}
+				sum += values[j]
+				sumSq += values[j] * values[j]
+				count++
+			}
+			if count < 2 {
+				continue
+			}
+			mean := sum / float64(count)
+			stddev := math.Sqrt(math.Max(sumSq/float64(count)-mean*mean, 0))
+			if stddev > 0 && math.Abs(values[i]-mean) > threshold*stddev {
+				results[i]["anomaly"] = true
+			}
+		}
+	}
+}
+
+// envFloat reads a float env var, falling back to def when unset or invalid
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("Warning: Invalid %s %q, using default %g", name, v, def)
+		return def
+	}
+	return f
+}
+
+// apiKeyFromRequest returns the key sent in X-API-Key or an "Authorization: Bearer" header
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return key
+	}
+	return ""
+}
+
+// hasAPIKey reports whether r carries the expected key; an empty expected key disables the check
+func hasAPIKey(r *http.Request, expected string) bool {
+	if expected == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(apiKeyFromRequest(r)), []byte(expected)) == 1
+}
+
+// canWrite reports whether r may modify stored readings: a tenant key may
+// change its own location's readings, other requests need the write key
+func canWrite(r *http.Request, writeKey string) bool {
+	if _, ok := tenantLocation(r.Context()); ok {
+		return true
+	}
+	return hasAPIKey(r, writeKey)
+}
+
+// tenantKey is the context key holding the tenant a request's API key belongs to
+type tenantKey struct{}
+
+// tenant is the location a tenant API key is bound to, with its index in
+// tenantLocations
+type tenant struct {
+	location string
+	index    int
+}
+
+// tenantLocation returns the location the request's API key is bound to
+func tenantLocation(ctx context.Context) (string, bool) {
+	t, ok := ctx.Value(tenantKey{}).(tenant)
+	return t.location, ok
+}
+
+// tenantLocations are the locations tenant keys are bound to, set once at
+// startup. SQL reads them through tenant_location(index), so a configured
+// location never becomes part of a query's text.
+var tenantLocations []string
+
+// registerSQLFunctions is the ConnectHook of every database connection
+func registerSQLFunctions(conn *sqlite3.SQLiteConn) error {
+	return conn.RegisterFunc("tenant_location", func(index int64) (string, error) {
+		if index < 0 || index >= int64(len(tenantLocations)) {
+			return "", fmt.Errorf("no tenant location %d", index)
+		}
+		return tenantLocations[index], nil
+	}, true)
+}
+
+// scopeTable restricts a table expression to the request's tenant location,
+// the way withoutWarmup drops warmup readings, and returns it unchanged for
+// other requests
+func scopeTable(ctx context.Context, table string) string {
+	t, ok := ctx.Value(tenantKey{}).(tenant)
+	if !ok {
+		return table
+	}
+	return `(SELECT * FROM ` + table + ` WHERE location = tenant_location(` + strconv.Itoa(t.index) + `))`
+}
+
+// tenantOpenPaths stay reachable without a key so probes and docs keep working
+var tenantOpenPaths = map[string]bool{"/health": true, "/version": true, "/openapi.json": true}
+
+// tenantAuth requires an API key on API routes once tenant keys are
+// configured. A tenant key scopes the request to its location; the admin and
+// write keys stay unscoped so operators can still reach every location.
+type tenantAuth struct {
+	keys      map[string]int // API key -> index into locations
+	locations []string
+	operators []string
+}
+
+func newTenantAuth(keys map[string]string, operatorKeys ...string) *tenantAuth {
+	t := &tenantAuth{keys: map[string]int{}}
+	t.locations = slices.Compact(slices.Sorted(maps.Values(keys)))
+	for key, location := range keys {
+		t.keys[key] = slices.Index(t.locations, location)
+	}
+	for _, key := range operatorKeys {
+		if key != "" {
+			t.operators = append(t.operators, key)
+		}
+	}
+	return t
+}
+
+// lookup compares key against every tenant key in constant time
+func (t *tenantAuth) lookup(key string) (match tenant, ok bool) {
+	for k, index := range t.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			match, ok = tenant{location: t.locations[index], index: index}, true
+		}
+	}
+	return match, ok
+}
+
+func (t *tenantAuth) isOperator(key string) bool {
+	match := false
+	for _, k := range t.operators {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			match = true
+		}
+	}
+	return match
+}
+
+func (t *tenantAuth) wrap(next http.Handler) http.Handler {
+	if len(t.keys) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAPIPath(r.URL.Path) || tenantOpenPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := apiKeyFromRequest(r)
+		if key == "" {
+			writeJSONError(w, http.StatusUnauthorized, "API key required")
+			return
+		}
+		if match, ok := t.lookup(key); ok {
+			r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, match))
+		} else if !t.isOperator(key) {
+			writeJSONError(w, http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// eventAtLocation reports whether an /events payload is a reading from location
+func eventAtLocation(payload []byte, location string) bool {
+	var event struct {
+		Location string `json:"location"`
+	}
+	return json.Unmarshal(payload, &event) == nil && event.Location == location
+}
+
+// loadTimezone resolves the local timezone used for day boundaries and CSV output.
+// A fixed offset (TZ_OFFSET_MINUTES, no tz database needed) wins over a named
+// zone (TIMEZONE, e.g. "Asia/Kolkata"); with neither set, IST (UTC+5:30) is used.
+func loadTimezone(cfg Config) (*time.Location, error) {
+	if cfg.TZOffsetMinutes != nil {
+		minutes := *cfg.TZOffsetMinutes
+		if minutes < -14*60 || minutes > 14*60 {
+			return nil, fmt.Errorf("invalid TZ_OFFSET_MINUTES %d: must be between -840 and 840", minutes)
+		}
+		sign := "+"
+		abs := minutes
+		if minutes < 0 {
+			sign, abs = "-", -minutes
+		}
+		return time.FixedZone(fmt.Sprintf("UTC%s%02d:%02d", sign, abs/60, abs%60), minutes*60), nil
+	}
+
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TIMEZONE %q: %w", cfg.Timezone, err)
+		}
+		return loc, nil
+	}
+
+	return time.FixedZone("IST", 5*60*60+30*60), nil
+}
+
+// startOfLocalDay returns the first instant of the given calendar day in loc.
+// time.Date is ambiguous around DST transitions that happen at midnight: when
+// midnight is skipped it may return 23:00 on the previous day, and when midnight
+// repeats it may return the later occurrence. Both cases are corrected here.
+func startOfLocalDay(year int, month time.Month, day int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	y, m, d := t.Date()
+
+	// Midnight fell into a spring-forward gap: the day starts at the transition
+	if t.Hour() != 0 {
+		if _, end := t.ZoneBounds(); !end.IsZero() {
+			return end
+		}
+		return t
+	}
+
+	// Midnight repeated after a fall-back: prefer the earlier occurrence
+	if start, _ := t.ZoneBounds(); !start.IsZero() {
+		_, prevOffset := start.Add(-time.Second).Zone()
+		_, offset := t.Zone()
+		if prevOffset > offset {
+			earlier := t.Add(-time.Duration(prevOffset-offset) * time.Second)
+			ey, em, ed := earlier.Date()
+			if ey == y && em == m && ed == d && earlier.Hour() == 0 && earlier.Minute() == 0 {
+				return earlier
+			}
+		}
+	}
+	return t
+}
+
+// localDayBounds returns the start and end of the local day daysAgo days
+// before the day containing now, which may be 23 or 25 hours long
+func localDayBounds(now time.Time, daysAgo int, loc *time.Location) (time.Time, time.Time) {
+	now = now.In(loc)
+	start := startOfLocalDay(now.Year(), now.Month(), now.Day()-daysAgo, loc)
+	end := startOfLocalDay(now.Year(), now.Month(), now.Day()-daysAgo+1, loc)
+	return start, end
+}
+
+// offsetSpan is a stretch of time over which a zone keeps one UTC offset
+type offsetSpan struct {
+	start, end time.Time
+	offset     int // seconds east of UTC
+}
+
+// offsetSpans splits [start, end) at the UTC offset changes of loc, so each
+// span can be shifted to local time with a fixed SQLite modifier
+func offsetSpans(start, end time.Time, loc *time.Location) []offsetSpan {
+	var spans []offsetSpan
+	for t := start; t.Before(end); {
+		local := t.In(loc)
+		_, offset := local.Zone()
+		_, next := local.ZoneBounds()
+		if next.IsZero() || next.After(end) {
+			next = end
+		}
+		spans = append(spans, offsetSpan{start: t, end: next, offset: offset})
+		t = next
+	}
+	return spans
+}
+
+// decodeJSONBody decodes the request body into dst, reading at most limit bytes.
+// A body sent with Content-Encoding: gzip is decompressed first, and limit then
+// applies to both the compressed and the decompressed size. On failure it
+// writes a 413 (body too large), 415 (unsupported encoding) or 400 response
+// and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}, limit int64) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	var body io.Reader = r.Body
+	compressed := false
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid gzip body: %v", err), http.StatusBadRequest)
+			return false
+		}
+		defer gz.Close()
+		body = http.MaxBytesReader(w, gz, limit)
+		compressed = true
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported Content-Encoding %q (expected gzip)", encoding), http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	if err := json.NewDecoder(body).Decode(dst); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", maxErr.Limit))
+			return false
+		}
+
+		var corrupt flate.CorruptInputError
+		if compressed && (errors.As(err, &corrupt) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF)) {
+			http.Error(w, fmt.Sprintf("Invalid gzip body: %v", err), http.StatusBadRequest)
+			return false
+		}
+
+		// A well-formed body with a wrongly typed field gets a field error
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			want := jsonTypeName(typeErr.Type)
+			if h, ok := dst.(interface{ fieldHint(string) string }); ok && h.fieldHint(typeErr.Field) != "" {
+				want = h.fieldHint(typeErr.Field)
+			}
+			writeValidationErrors(w, []ValidationError{{
+				Field:   typeErr.Field,
+				Message: fmt.Sprintf("%s must be %s, got %s", typeErr.Field, want, typeErr.Value),
+			}})
+			return false
+		}
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// jsonTypeName describes the JSON value expected for a Go type
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// queryCoverage reports how much of [start, end) has elapsed at now and how
+// many readings it holds relative to one per interval over the elapsed part.
+// coverage_fraction is capped at 1 and is null before any time has elapsed.
+func queryCoverage(ctx context.Context, db *sql.DB, shards *shardStore, start, end, now time.Time, interval time.Duration, excludeWarmup bool) (map[string]interface{}, error) {
+	conn, table, release, err := shards.readConn(ctx, db, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if excludeWarmup {
+		table = withoutWarmup(table)
+	}
+
+	var samples int
+	err = conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+table+` WHERE timestamp >= ? AND timestamp < ?`,
+		start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339)).Scan(&samples)
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := min(max(now.Sub(start), 0), end.Sub(start))
+	expected := int(elapsed / interval)
+	results := map[string]interface{}{
+		"samples":           samples,
+		"expected_samples":  expected,
+		"expected_interval": interval.String(),
+		"elapsed_fraction":  roundTo(elapsed.Seconds()/end.Sub(start).Seconds(), 4),
+		"coverage_fraction": nil,
+	}
+	if expected > 0 {
+		results["coverage_fraction"] = roundTo(min(float64(samples)/float64(expected), 1), 4)
+	}
+	return results, nil
+}
+
+// parseExpectedInterval reads ?expected_interval=, falling back to def
+func parseExpectedInterval(q url.Values, def time.Duration) (time.Duration, error) {
+	v := q.Get("expected_interval")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid expected_interval %q (expected a duration such as 1m)", v)
+	}
+	return d, nil
+}
+
+// queryStats returns max/min/avg aggregates for each metric over [start, end).
+// Metrics with no data in the window are omitted from the result, as are
+// warmup readings when excludeWarmup is set. Each requested percentile adds
+// a pNN_<metric> key per metric. Whole hours rolled up by rollup are read
+// from hourly_summary unless warmup readings are excluded; percentiles are
+// always computed from the readings.
+func queryStats(ctx context.Context, db *sql.DB, shards *shardStore, rollup *hourlyRollup, start, end time.Time, excludeWarmup bool, percentiles []float64) (map[string]interface{}, error) {
+	conn, table, release, err := shards.readConn(ctx, db, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if excludeWarmup {
+		table = withoutWarmup(table)
+	}
+
+	sqlStmt := `
+		SELECT 
+			MAX(temperature), MIN(temperature), AVG(temperature),
+			MAX(humidity), MIN(humidity), AVG(humidity),
+			MAX(pressure), MIN(pressure), AVG(pressure),
+			COUNT(gas_resistance), MAX(gas_resistance), MIN(gas_resistance), AVG(gas_resistance),
+			COUNT(aqi), MAX(aqi), MIN(aqi), AVG(aqi)
+		FROM ` + table + ` 
+		WHERE timestamp >= ? AND timestamp < ?`
+	args := []interface{}{start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339)}
+
+	if !excludeWarmup {
+		from, to, ok, err := rollup.span(ctx, conn, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			var partials string
+			partials, args = hourlyPartials(ctx, table, start, end, from, to, false)
+			sqlStmt = `
+				SELECT
+					MAX(max_temperature), MIN(min_temperature), SUM(avg_temperature * count) / SUM(count),
+					MAX(max_humidity), MIN(min_humidity), SUM(avg_humidity * count) / SUM(count),
+					MAX(max_pressure), MIN(min_pressure), SUM(avg_pressure * count) / SUM(count),
+					COALESCE(SUM(gas_resistance_count), 0), MAX(max_gas_resistance), MIN(min_gas_resistance),
+					SUM(avg_gas_resistance * gas_resistance_count) / SUM(gas_resistance_count),
+					COALESCE(SUM(aqi_count), 0), MAX(max_aqi), MIN(min_aqi), SUM(avg_aqi * aqi_count) / SUM(aqi_count)
+				FROM ` + partials
+		}
+	}
+
+	row := conn.QueryRowContext(ctx, sqlStmt, args...)
+
+	var maxTemp, minTemp, avgTemp sql.NullFloat64
+	var maxHum, minHum, avgHum sql.NullFloat64
+	var maxPres, minPres, avgPres sql.NullFloat64
+	var gasCount, aqiCount int
+	var maxGas, minGas sql.NullInt64
+	var avgGas sql.NullFloat64
+	var maxAQI, minAQI sql.NullInt64
+	var avgAQI sql.NullFloat64
+
+	err = row.Scan(&maxTemp, &minTemp, &avgTemp, &maxHum, &minHum, &avgHum,
+		&maxPres, &minPres, &avgPres, &gasCount, &maxGas, &minGas, &avgGas,
+		&aqiCount, &maxAQI, &minAQI, &avgAQI)
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]interface{})
+
+	if maxTemp.Valid {
+		results["max_temperature"] = maxTemp.Float64
+		results["min_temperature"] = minTemp.Float64
+		results["avg_temperature"] = avgTemp.Float64
+	}
+	if maxHum.Valid {
+		results["max_humidity"] = maxHum.Float64
+		results["min_humidity"] = minHum.Float64
+		results["avg_humidity"] = avgHum.Float64
+	}
+	if maxPres.Valid {
+		results["max_pressure"] = maxPres.Float64
+		results["min_pressure"] = minPres.Float64
+		results["avg_pressure"] = avgPres.Float64
+	}
+	// gas_resistance and aqi are optional, so a window may hold only NULLs.
+	// Key the blocks on the non-null count and require every aggregate, so
+	// they are either complete or absent whatever SQLite returns for the rest.
+	if gasCount > 0 && maxGas.Valid && minGas.Valid && avgGas.Valid {
+		results["max_gas_resistance"] = maxGas.Int64
+		results["min_gas_resistance"] = minGas.Int64
+		results["avg_gas_resistance"] = avgGas.Float64
+	}
+	if aqiCount > 0 && maxAQI.Valid && minAQI.Valid && avgAQI.Valid {
+		results["max_aqi"] = maxAQI.Int64
+		results["min_aqi"] = minAQI.Int64
+		results["avg_aqi"] = avgAQI.Float64
+		results["aqi_category"] = aqiCategory(int(math.Round(avgAQI.Float64)))
+	}
+
+	if len(percentiles) == 0 {
+		return results, nil
+	}
+
+	// SQLite has no percentile aggregate, so collect every metric in one pass
+	// over the window and interpolate over the sorted values
+	metrics := []string{"temperature", "humidity", "pressure", "gas_resistance", "aqi"}
+	rows, err := conn.QueryContext(ctx, `SELECT `+strings.Join(metrics, ", ")+` FROM `+table+`
+		WHERE timestamp >= ? AND timestamp < ?`,
+		start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([][]float64, len(metrics))
+	scanned := make([]sql.NullFloat64, len(metrics))
+	dest := make([]interface{}, len(metrics))
+	for i := range scanned {
+		dest[i] = &scanned[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, v := range scanned {
+			if v.Valid {
+				values[i] = append(values[i], v.Float64)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, metric := range metrics {
+		if len(values[i]) == 0 {
+			continue
+		}
+		slices.Sort(values[i])
+		for _, p := range percentiles {
+			results["p"+strconv.FormatFloat(p, 'f', -1, 64)+"_"+metric] = percentile(values[i], p)
+		}
+	}
+
+	return results, nil
+}
+
+// includeNullStats sets the keys queryStats omitted for lack of data to nil,
+// so ?include_nulls=true responses carry every key it can return for the
+// given percentiles
+func includeNullStats(results map[string]interface{}, percentiles []float64) {
+	keys := []string{"aqi_category"}
+	for _, metric := range []string{"temperature", "humidity", "pressure", "gas_resistance", "aqi"} {
+		keys = append(keys, "max_"+metric, "min_"+metric, "avg_"+metric)
+		for _, p := range percentiles {
+			keys = append(keys, "p"+strconv.FormatFloat(p, 'f', -1, 64)+"_"+metric)
+		}
+	}
+	for _, key := range keys {
+		if _, ok := results[key]; !ok {
+			results[key] = nil
+		}
+	}
+}
+
+// percentile returns the p-th percentile (0-100) of sorted, interpolating
+// linearly between the closest ranks
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	if lo >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (rank-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+// maxPercentiles caps how many percentiles one stats request may ask for
+const maxPercentiles = 10
+
+// parsePercentiles reads ?percentiles=50,95,99, defaulting to the median and
+// 95th percentile
+func parsePercentiles(q url.Values) ([]float64, error) {
+	v := q.Get("percentiles")
+	if v == "" {
+		return []float64{50, 95}, nil
+	}
+	var percentiles []float64
+	for _, part := range strings.Split(v, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile %q (expected a number from 0 to 100)", part)
+		}
+		if !slices.Contains(percentiles, p) {
+			percentiles = append(percentiles, p)
+		}
+	}
+	if len(percentiles) > maxPercentiles {
+		return nil, fmt.Errorf("too many percentiles (at most %d)", maxPercentiles)
+	}
+	return percentiles, nil
+}
+
+// windRainColumns are the optional wind and rain columns, in windRain order
+const windRainColumns = `wind_speed, wind_direction, rainfall`
+
+// windRain holds the optional wind and rain columns of a row
+type windRain struct {
+	WindSpeed, WindDirection, Rainfall sql.NullFloat64
+}
+
+// addTo sets the non-null wind and rain values on result
+func (wr windRain) addTo(result map[string]interface{}) {
+	if wr.WindSpeed.Valid {
+		result["wind_speed"] = wr.WindSpeed.Float64
+	}
+	if wr.WindDirection.Valid {
+		result["wind_direction"] = wr.WindDirection.Float64
+	}
+	if wr.Rainfall.Valid {
+		result["rainfall"] = wr.Rainfall.Float64
+	}
+}
+
+// derivedColumns are the values computed and stored at insert time when
+// STORE_DERIVED=true, in derivedValues order. The columns only exist then.
+var derivedColumns = []string{"dew_point", "absolute_humidity"}
+
+// derivedValues holds the stored derived columns of a row
+type derivedValues struct {
+	DewPoint, AbsoluteHumidity sql.NullFloat64
+}
+
+// addTo sets the non-null stored values on result, replacing any computed ones
+func (dv derivedValues) addTo(result map[string]interface{}) {
+	if dv.DewPoint.Valid {
+		result["dew_point"] = dv.DewPoint.Float64
+	}
+	if dv.AbsoluteHumidity.Valid {
+		result["absolute_humidity"] = dv.AbsoluteHumidity.Float64
+	}
+}
+
+// derivedArgs returns the derivedColumns insert values for a reading
+func derivedArgs(temp, relHumidity float64, decimals int) []interface{} {
+	var dew interface{}
+	if dp, ok := dewPoint(temp, relHumidity); ok {
+		dew = roundTo(dp, decimals)
+	}
+	return []interface{}{dew, roundTo(absoluteHumidity(temp, relHumidity), decimals)}
+}
+
+// queryLatest returns the most recently inserted reading, or sql.ErrNoRows
+// when the table is empty. With storeDerived the stored derived columns are
+// read as well; with excludeWarmup the newest non-warmup reading is returned.
+// Columns no field in fields needs are not selected; nil selects them all.
+func queryLatest(ctx context.Context, db *sql.DB, shards *shardStore, decimals int, storeDerived, excludeWarmup bool, fields map[string]bool) (map[string]interface{}, error) {
+	columns := recordColumns + `, ` + windRainColumns + `, warmup, note, altitude`
+	if storeDerived {
+		columns += `, ` + strings.Join(derivedColumns, ", ")
+	}
+	sqlStmt := `SELECT ` + selectFields(columns, fields) + ` FROM ` + scopeTable(ctx, "temp")
+	if excludeWarmup {
+		sqlStmt += ` WHERE warmup = 0`
+	}
+	sqlStmt += ` ORDER BY id DESC LIMIT 1`
+
+	var wr windRain
+	var warmup bool
+	var note sql.NullString
+	var altitude sql.NullFloat64
+	var dv derivedValues
+	extra := []interface{}{&wr.WindSpeed, &wr.WindDirection, &wr.Rainfall, &warmup, &note, &altitude}
+	if storeDerived {
+		extra = append(extra, &dv.DewPoint, &dv.AbsoluteHumidity)
+	}
+	var rec DatabaseRecord
+	err := shards.newestFirst(db, func(db *sql.DB) error {
+		var err error
+		rec, err = scanReading(db.QueryRowContext(ctx, sqlStmt), extra...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	results := rec.result()
+
+	// Derived water vapour density in g/m³
+	results["absolute_humidity"] = roundTo(absoluteHumidity(rec.Temperature, rec.Humidity), decimals)
+
+	if rec.AQI != nil {
+		results["aqi_category"] = aqiCategory(*rec.AQI)
+	}
+	wr.addTo(results)
+	dv.addTo(results)
+	if warmup {
+		results["warmup"] = true
+	}
+	if note.Valid && note.String != "" {
+		results["note"] = note.String
+	}
+	addSeaLevelPressure(results, rec.Temperature, rec.Pressure, altitude, decimals)
+
+	return results, nil
+}
+
+// latestNonNullMetrics are the metrics queryLatestNonNull reports
+var latestNonNullMetrics = []string{"temperature", "humidity", "pressure", "gas_resistance", "aqi", "wind_speed", "wind_direction", "rainfall"}
+
+// queryLatestNonNull returns, for each metric, the most recently inserted
+// non-null value as {"value", "timestamp"}, so the timestamps may differ
+// between metrics. Metrics never recorded are null; it returns sql.ErrNoRows
+// when the table is empty.
+func queryLatestNonNull(ctx context.Context, db *sql.DB, shards *shardStore, decimals int, excludeWarmup bool) (map[string]interface{}, error) {
+	where := ""
+	if excludeWarmup {
+		where = " AND warmup = 0"
+	}
+	results := map[string]interface{}{}
+	found := false
+	for _, metric := range latestNonNullMetrics {
+		// metric comes from the fixed list above
+		var value float64
+		var timestampStr string
+		err := shards.newestFirst(db, func(db *sql.DB) error {
+			return db.QueryRowContext(ctx, `SELECT `+metric+`, timestamp FROM `+scopeTable(ctx, "temp")+` WHERE `+metric+` IS NOT NULL`+where+` ORDER BY id DESC LIMIT 1`).Scan(&value, &timestampStr)
+		})
+		if err == sql.ErrNoRows {
+			results[metric] = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		entry := map[string]interface{}{"value": roundTo(value, decimals), "timestamp": timestampStr}
+		if metric == "aqi" {
+			entry["aqi_category"] = aqiCategory(int(value))
+		}
+		results[metric] = entry
+	}
+	if !found {
+		return nil, sql.ErrNoRows
+	}
+	return results, nil
+}
+
+// latestValidators derives the ETag and Last-Modified time of a /temp
+// reading. The ETag hashes the reading's JSON, so edits to the row through
+// PATCH /temp/{id} also change it, and a cached reading needs no query.
+func latestValidators(reading map[string]interface{}) (etag string, modified time.Time) {
+	body, _ := json.Marshal(reading)
+	sum := sha256.Sum256(body)
+	if ts, ok := reading["timestamp"].(string); ok {
+		modified, _ = time.Parse(time.RFC3339, ts)
+	}
+	return `"` + hex.EncodeToString(sum[:8]) + `"`, modified
+}
+
+// notModified reports whether the request's conditional headers match the
+// current validators. If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// parseDateRange parses the RFC3339 bounds of q and returns them in UTC,
+// reporting each missing, malformed or out-of-order bound as a field error
+func parseDateRange(q DateRangeQuery) (time.Time, time.Time, []ValidationError) {
+	var errs []ValidationError
+	parse := func(field, value, example string) time.Time {
+		if value == "" {
+			errs = append(errs, ValidationError{Field: field, Message: field + " is required"})
+			return time.Time{}
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf("%s must be an RFC3339 timestamp (e.g. %s), got %q", field, example, value)})
+		}
+		return t
+	}
+	startDate := parse("startDate", q.StartDate, "2024-01-15T00:00:00Z")
+	endDate := parse("endDate", q.EndDate, "2024-01-15T23:59:59Z")
+
+	if len(errs) == 0 && endDate.Before(startDate) {
+		errs = append(errs, ValidationError{Field: "endDate", Message: "endDate must not be before startDate"})
+	}
+	if len(errs) > 0 {
+		return time.Time{}, time.Time{}, errs
+	}
+	return startDate.UTC(), endDate.UTC(), nil
+}
+
+// checkRangeSpan rejects ranges longer than maxDays; 0 means unlimited
+func checkRangeSpan(start, end time.Time, maxDays int) []ValidationError {
+	if maxDays <= 0 {
+		return nil
+	}
+	span := end.Sub(start)
+	if span > time.Duration(maxDays)*24*time.Hour {
+		return []ValidationError{{Field: "endDate", Message: fmt.Sprintf("range spans %.1f days; the maximum is %d days", span.Hours()/24, maxDays)}}
+	}
+	return nil
+}
+
+// toFloat converts a numeric result value to float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// percentChange returns the change from previous to current in percent, or nil
+// when previous is zero
+func percentChange(previous, current float64) interface{} {
+	if previous == 0 {
+		return nil
+	}
+	return (current - previous) / math.Abs(previous) * 100
+}
+
+// csvOptions controls how CSV exports are formatted
+type csvOptions struct {
+	Delimiter    rune
+	DecimalComma bool
+	Decimals     int
+	Null         string // Rendering of missing gas_resistance/aqi values
+	// Go layout for timestamps; "MST" renders the configured zone's abbreviation
+	TimestampFormat string
+}
+
+// defaultCSVTimestampFormat is the export's local timestamp layout
+const defaultCSVTimestampFormat = "2006-01-02 15:04:05 MST"
+
+// maxTimestampFormatLength bounds ?ts_format=
+const maxTimestampFormatLength = 64
+
+// checkTimestampLayout accepts a Go time layout only if a timestamp formatted
+// with it parses back to the same second, so exports stay readable (including
+// by ?ts_format= on /import/csv). The check runs in UTC: names of fixed-offset
+// zones such as "UTC+05:30" don't parse back as abbreviations.
+func checkTimestampLayout(layout string) error {
+	if len(layout) > maxTimestampFormatLength || strings.ContainsAny(layout, "\r\n") {
+		return fmt.Errorf("invalid ts_format %q: must be a single line of at most %d bytes", layout, maxTimestampFormatLength)
+	}
+	ref := time.Date(2024, time.November, 23, 14, 5, 9, 0, time.UTC)
+	t, err := time.Parse(layout, ref.Format(layout))
+	if err != nil || !t.Equal(ref) {
+		return fmt.Errorf("invalid ts_format %q: it must use Go layout elements (e.g. 02/01/2006 15:04:05 MST) and include the date and time to the second", layout)
+	}
+	return nil
+}
+
+// csvNullValues maps ?na= choices to the text written for a missing value
+var csvNullValues = map[string]string{
+	"blank": "",
+	"na":    "NA",
+	"zero":  "0",
+}
+
+// csvDelimiterNames are accepted aliases for ?delimiter=. A literal ";" must be
+// sent percent-encoded (%3B) since Go's query parser rejects raw semicolons.
+var csvDelimiterNames = map[string]string{
+	"comma":     ",",
+	"semicolon": ";",
+	"tab":       "\t",
+	"pipe":      "|",
+}
+
+// parseCSVOptions reads ?delimiter=, ?decimal=dot|comma, ?na= and ?ts_format=,
+// defaulting to comma-delimited, dot-decimal
+func parseCSVOptions(q url.Values) (csvOptions, error) {
+	opts := csvOptions{Delimiter: ',', Decimals: 2, TimestampFormat: defaultCSVTimestampFormat}
+
+	if d := q.Get("delimiter"); d != "" {
+		if alias, ok := csvDelimiterNames[d]; ok {
+			d = alias
+		}
+		r, size := utf8.DecodeRuneInString(d)
+		if size != len(d) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+			return opts, fmt.Errorf("invalid delimiter %q: must be a single character other than a quote or newline", d)
+		}
+		opts.Delimiter = r
+	}
+
+	switch q.Get("decimal") {
+	case "", "dot":
+	case "comma":
+		opts.DecimalComma = true
+	default:
+		return opts, fmt.Errorf("invalid decimal %q (expected dot or comma)", q.Get("decimal"))
+	}
+
+	if v := q.Get("na"); v != "" {
+		null, ok := csvNullValues[v]
+		if !ok {
+			return opts, fmt.Errorf("invalid na %q (expected blank, na or zero)", v)
+		}
+		opts.Null = null
+	}
+
+	if layout := q.Get("ts_format"); layout != "" {
+		if err := checkTimestampLayout(layout); err != nil {
+			return opts, err
+		}
+		opts.TimestampFormat = layout
+	}
+
+	return opts, nil
+}
+
+// readingFields are the metric keys a ?fields= selection may name, including
+// derived values that only some endpoints return
+var readingFields = []string{"temperature", "humidity", "pressure", "gas_resistance", "aqi", "absolute_humidity", "dew_point", "wind_speed", "wind_direction", "rainfall", "sea_level_pressure"}
+
+// parseFields reads ?fields=a,b,c. A nil map means every field was requested.
+func parseFields(q url.Values) (map[string]bool, error) {
+	v := q.Get("fields")
+	if v == "" {
+		return nil, nil
+	}
+	fields := map[string]bool{}
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(readingFields, name) {
+			return nil, fmt.Errorf("unknown field %q (expected %s)", name, strings.Join(readingFields, ", "))
+		}
+		fields[name] = true
+	}
+	return fields, nil
+}
+
+// filterFields removes metric keys not in fields from result; identifying keys
+// such as timestamp, id and location are always kept
+func filterFields(result map[string]interface{}, fields map[string]bool) {
+	if fields == nil {
+		return
+	}
+	for _, name := range readingFields {
+		if !fields[name] {
+			delete(result, name)
+		}
+	}
+	if !fields["aqi"] {
+		delete(result, "aqi_category")
+	}
+}
+
+// fieldColumns maps the temp columns a ?fields= selection can leave out to
+// the fields that are read or computed from them
+var fieldColumns = map[string][]string{
+	"temperature":       {"temperature", "absolute_humidity", "dew_point", "sea_level_pressure"},
+	"humidity":          {"humidity", "absolute_humidity", "dew_point"},
+	"pressure":          {"pressure", "sea_level_pressure"},
+	"gas_resistance":    {"gas_resistance"},
+	"aqi":               {"aqi"},
+	"wind_speed":        {"wind_speed"},
+	"wind_direction":    {"wind_direction"},
+	"rainfall":          {"rainfall"},
+	"altitude":          {"sea_level_pressure"},
+	"dew_point":         {"dew_point"},
+	"absolute_humidity": {"absolute_humidity"},
+}
+
+// fieldColumn returns column, or a constant standing in for it when no field
+// in fields needs it: 0 for the NOT NULL metrics, NULL otherwise. Queries
+// keep their shape and scans, and filterFields drops the stand-ins.
+func fieldColumn(column string, fields map[string]bool) string {
+	needed, ok := fieldColumns[column]
+	if fields == nil || !ok || slices.ContainsFunc(needed, func(field string) bool { return fields[field] }) {
+		return column
+	}
+	switch column {
+	case "temperature", "humidity", "pressure":
+		return "0"
+	}
+	return "NULL"
+}
+
+// selectFields applies fieldColumn to a comma-separated column list, naming
+// each stand-in after the column it replaces
+func selectFields(columns string, fields map[string]bool) string {
+	parts := strings.Split(columns, ", ")
+	for i, column := range parts {
+		if v := fieldColumn(column, fields); v != column {
+			parts[i] = v + " AS " + column
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseTimeFormat reads ?time_format=, defaulting to rfc3339
+func parseTimeFormat(q url.Values) (string, error) {
+	switch v := q.Get("time_format"); v {
+	case "":
+		return "rfc3339", nil
+	case "rfc3339", "epoch_ms", "epoch_s":
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid time_format %q (expected rfc3339, epoch_ms or epoch_s)", v)
+	}
+}
+
+// formatTimestamp replaces result's RFC3339 timestamp with a Unix epoch number
+// when an epoch format was requested
+func formatTimestamp(result map[string]interface{}, format string) {
+	if format == "rfc3339" {
+		return
+	}
+	s, ok := result["timestamp"].(string)
+	if !ok {
+		return
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return
+	}
+	if format == "epoch_ms" {
+		result["timestamp"] = t.UnixMilli()
+	} else {
+		result["timestamp"] = t.Unix()
+	}
+}
+
+// readingsByTimestamp reshapes results into an object keyed by each reading's
+// RFC3339 timestamp, as some charting libraries expect. Results are in time order, so
+// when two readings share a timestamp the later row wins.
+func readingsByTimestamp(results []map[string]interface{}) map[string]map[string]interface{} {
+	shaped := make(map[string]map[string]interface{}, len(results))
+	for _, result := range results {
+		key := fmt.Sprint(result["timestamp"])
+		delete(result, "timestamp")
+		shaped[key] = result
+	}
+	return shaped
+}
+
+// formatFloat renders v with the configured decimals and decimal separator
+func (o csvOptions) formatFloat(v float64) string {
+	s := strconv.FormatFloat(v, 'f', o.Decimals, 64)
+	if o.DecimalComma {
+		s = strings.Replace(s, ".", ",", 1)
+	}
+	return s
+}
+
+// csvFlushEvery is how many rows writeCSVRows buffers before flushing to the client
+const csvFlushEvery = 1000
+
+// writeCSVRows writes the CSV header and one record per row as rows are read,
+// flushing periodically so large exports stream instead of buffering. Rows must
+// select recordColumns.
+// Timestamps are shown in loc. It returns the number of records written.
+func writeCSVRows(w http.ResponseWriter, r *http.Request, rows *sql.Rows, opts csvOptions, loc *time.Location) int {
+	writer := csv.NewWriter(w)
+	writer.Comma = opts.Delimiter
+	defer writer.Flush()
+	flusher, _ := w.(http.Flusher)
+
+	// Write CSV header
+	header := []string{"Temperature", "Humidity", "Pressure", "Gas_Resistance", "AQI", "Timestamp"}
+	if err := writer.Write(header); err != nil {
+		return 0
+	}
+
+	// Write data rows
+	written := 0
+	for rows.Next() {
+		rec, err := scanReading(rows)
+		if err != nil {
+			logf(r, "Row scan error: %v", err)
+			continue
+		}
+
+		// Timestamps are shown in local time
+		localTime := rec.Timestamp.In(loc)
+
+		gasStr := opts.Null
+		if rec.GasResistance != nil {
+			gasStr = strconv.Itoa(*rec.GasResistance)
+		}
+
+		aqiStr := opts.Null
+		if rec.AQI != nil {
+			aqiStr = strconv.Itoa(*rec.AQI)
+		}
+
+		record := []string{
+			opts.formatFloat(rec.Temperature),
+			opts.formatFloat(rec.Humidity),
+			opts.formatFloat(rec.Pressure),
+			gasStr,
+			aqiStr,
+			localTime.Format(opts.TimestampFormat),
+		}
+		if err := writer.Write(record); err != nil {
+			logf(r, "CSV write error: %v", err)
+			return written
+		}
+		written++
+
+		if written%csvFlushEvery == 0 {
+			writer.Flush()
+			if writer.Error() != nil {
+				// Client went away
+				return written
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logf(r, "Rows error: %v", err)
+	}
+	return written
+}
+
+// parquetRowGroupRows is how many rows the Parquet writer buffers before
+// writing a row group, which bounds memory for long ranges
+const parquetRowGroupRows = 10000
+
+// parquetReading is the Parquet export schema: a UTC millisecond timestamp,
+// DOUBLE metrics and nullable INT64 gas resistance and AQI
+type parquetReading struct {
+	Timestamp     time.Time `parquet:"timestamp,timestamp(millisecond)"`
+	Temperature   float64   `parquet:"temperature"`
+	Humidity      float64   `parquet:"humidity"`
+	Pressure      float64   `parquet:"pressure"`
+	GasResistance *int64    `parquet:"gas_resistance,optional"`
+	AQI           *int64    `parquet:"aqi,optional"`
+}
+
+// writeParquetRows streams rows selected with recordColumns as a Parquet file
+// of parquetReading rows. It returns the number of rows written.
+func writeParquetRows(w io.Writer, r *http.Request, rows *sql.Rows) (int64, error) {
+	pw := parquet.NewGenericWriter[parquetReading](w, parquet.MaxRowsPerRowGroup(parquetRowGroupRows))
+	var written int64
+	for rows.Next() {
+		rec, err := scanReading(rows)
+		if err != nil {
+			logf(r, "Row scan error: %v", err)
+			continue
+		}
+		row := parquetReading{
+			Timestamp:   rec.Timestamp.UTC(),
+			Temperature: rec.Temperature,
+			Humidity:    rec.Humidity,
+			Pressure:    rec.Pressure,
+		}
+		if rec.GasResistance != nil {
+			g := int64(*rec.GasResistance)
+			row.GasResistance = &g
+		}
+		if rec.AQI != nil {
+			a := int64(*rec.AQI)
+			row.AQI = &a
+		}
+		if _, err := pw.Write([]parquetReading{row}); err != nil {
+			return written, err
+		}
+		written++
+	}
+	if err := rows.Err(); err != nil {
+		return written, err
+	}
+	return written, pw.Close()
+}
+
+// csvImportRejection describes a CSV line that could not be imported
+type csvImportRejection struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// parseCSVReading parses an export-format record (Temperature, Humidity,
+// Pressure, Gas_Resistance, AQI, Timestamp). Timestamps may be RFC3339 or the
+// export's local "2006-01-02 15:04:05 MST" form, which is read in loc, or the
+// layout given as ?ts_format=.
+func parseCSVReading(record []string, opts csvOptions, loc *time.Location) (SensorData, error) {
+	var d SensorData
+	if len(record) != 6 {
+		return d, fmt.Errorf("expected 6 columns, got %d", len(record))
+	}
+
+	parseFloat := func(name, v string) (float64, error) {
+		v = strings.TrimSpace(v)
+		if opts.DecimalComma {
+			v = strings.Replace(v, ",", ".", 1)
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q", name, v)
+		}
+		return f, nil
+	}
+	// ?na=na lets an export made with the same option be imported again;
+	// zeros are always read as values
+	parseOptionalInt := func(name, v string) (*int, error) {
+		v = strings.TrimSpace(v)
+		if v == "" || (opts.Null == "NA" && v == "NA") {
+			return nil, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", name, v)
+		}
+		return &n, nil
+	}
+
+	var err error
+	if d.Temperature, err = parseFloat("temperature", record[0]); err != nil {
+		return d, err
+	}
+	if d.Humidity, err = parseFloat("humidity", record[1]); err != nil {
+		return d, err
+	}
+	if d.Pressure, err = parseFloat("pressure", record[2]); err != nil {
+		return d, err
+	}
+	if d.GasResistance, err = parseOptionalInt("gas_resistance", record[3]); err != nil {
+		return d, err
+	}
+	if d.AQI, err = parseOptionalInt("aqi", record[4]); err != nil {
+		return d, err
+	}
+
+	ts := strings.TrimSpace(record[5])
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil && opts.TimestampFormat != "" && opts.TimestampFormat != defaultCSVTimestampFormat {
+		t, err = time.ParseInLocation(opts.TimestampFormat, ts, loc)
+		if err != nil {
+			return d, fmt.Errorf("invalid timestamp %q for ts_format %q", ts, opts.TimestampFormat)
+		}
+	}
+	if err != nil {
+		// Drop the zone abbreviation; abbreviations are ambiguous, so the
+		// configured zone the export was written in is used instead
+		local := ts
+		if i := strings.LastIndex(ts, " "); i > len("2006-01-02") {
+			local = ts[:i]
+		}
+		t, err = time.ParseInLocation("2006-01-02 15:04:05", local, loc)
+		if err != nil {
+			return d, fmt.Errorf("invalid timestamp %q", ts)
+		}
+	}
+	d.Timestamp = t.UTC().Format(time.RFC3339)
+	return d, nil
+}
+
+// roundTo rounds v to the given number of decimal places
+func roundTo(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
+
+// roundMetrics rounds the measurement values in result (readings, their
+// avg_/min_/max_ aggregates and sparkline arrays) to the given decimals.
+// Other numbers such as rates and durations are left as computed.
+func roundMetrics(result map[string]interface{}, decimals int) {
+	for key, v := range result {
+		metric := key
+		for _, prefix := range []string{"avg_", "min_", "max_"} {
+			metric = strings.TrimPrefix(metric, prefix)
+		}
+		// Percentile keys look like p95_temperature
+		if p, rest, ok := strings.Cut(metric, "_"); ok && strings.HasPrefix(p, "p") {
+			if _, err := strconv.ParseFloat(p[1:], 64); err == nil {
+				metric = rest
+			}
+		}
+		if !slices.Contains(readingFields, metric) {
+			continue
+		}
+		switch n := v.(type) {
+		case float64:
+			result[key] = roundTo(n, decimals)
+		case []float64:
+			for i := range n {
+				n[i] = roundTo(n[i], decimals)
+			}
+		case []interface{}:
+			for i, x := range n {
+				if f, ok := x.(float64); ok {
+					n[i] = roundTo(f, decimals)
+				}
+			}
+		}
+	}
+}
+
+// linearFit returns the least-squares slope, intercept and R² of ys against xs
+func linearFit(xs, ys []float64) (slope, intercept, r2 float64) {
+	n := float64(len(xs))
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXY += xs[i] * ys[i]
+		sumXX += xs[i] * xs[i]
+	}
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, sumY / n, 0
+	}
+	slope = (n*sumXY - sumX*sumY) / denom
+	intercept = (sumY - slope*sumX) / n
+
+	meanY := sumY / n
+	var ssRes, ssTot float64
+	for i := range xs {
+		fit := slope*xs[i] + intercept
+		ssRes += (ys[i] - fit) * (ys[i] - fit)
+		ssTot += (ys[i] - meanY) * (ys[i] - meanY)
+	}
+	if ssTot == 0 {
+		return slope, intercept, 1
+	}
+	return slope, intercept, 1 - ssRes/ssTot
+}
+
+// timeWeightedMean weights each value by the time until the next one, and the
+// last by the time until end, capping every weight at maxGap so an outage
+// does not stretch one reading over it. times must be ascending. ok is false
+// when the weights sum to zero.
+func timeWeightedMean(times []time.Time, values []float64, end time.Time, maxGap time.Duration) (mean float64, covered time.Duration, ok bool) {
+	var weighted float64
+	for i := range times {
+		next := end
+		if i+1 < len(times) {
+			next = times[i+1]
+		}
+		weight := min(max(next.Sub(times[i]), 0), maxGap)
+		weighted += values[i] * weight.Seconds()
+		covered += weight
+	}
+	if covered <= 0 {
+		return 0, 0, false
+	}
+	return weighted / covered.Seconds(), covered, true
+}
+
+// pearson returns the Pearson correlation coefficient of xs and ys. ok is
+// false when either series has zero variance and the coefficient is undefined.
+func pearson(xs, ys []float64) (r float64, ok bool) {
+	n := float64(len(xs))
+	var sumX, sumY float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var cov, varX, varY float64
+	for i := range xs {
+		dx, dy := xs[i]-meanX, ys[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return 0, false
+	}
+	return cov / math.Sqrt(varX*varY), true
+}
+
+// pressureSteadyRate is the hPa/hour below which pressure counts as steady
+// (the usual 1 hPa per 3 hours barometric tendency convention)
+const pressureSteadyRate = 1.0 / 3.0
+
+// pressureTrend fits a line to pressure readings over the last window and
+// classifies it as rising, falling or steady. It returns nil when fewer than
+// two readings fall in the window.
+func pressureTrend(ctx context.Context, db *sql.DB, shards *shardStore, window time.Duration) (map[string]interface{}, error) {
+	end := time.Now().UTC()
+	start := end.Add(-window)
+	conn, table, release, err := shards.readConn(ctx, db, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := conn.QueryContext(ctx, `SELECT `+recordColumns+` FROM `+table+` WHERE timestamp >= ? AND timestamp <= ? ORDER BY timestamp ASC`,
+		start.Format(time.RFC3339), end.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hours, pressures []float64
+	var first, last time.Time
+	for rows.Next() {
+		rec, err := scanReading(rows)
+		if err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		if len(hours) == 0 {
+			first = rec.Timestamp
+		}
+		last = rec.Timestamp
+		hours = append(hours, rec.Timestamp.Sub(start).Hours())
+		pressures = append(pressures, rec.Pressure)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(pressures) < 2 {
+		return nil, nil
+	}
+
+	rate, _, _ := linearFit(hours, pressures)
+	trend := "steady"
+	if rate >= pressureSteadyRate {
+		trend = "rising"
+	} else if rate <= -pressureSteadyRate {
+		trend = "falling"
+	}
+
+	return map[string]interface{}{
+		"trend":             trend,
+		"rate_hpa_per_hour": rate,
+		"start_pressure":    pressures[0],
+		"end_pressure":      pressures[len(pressures)-1],
+		"start_time":        first.Format(time.RFC3339),
+		"end_time":          last.Format(time.RFC3339),
+		"samples":           len(pressures),
+		"window":            window.String(),
+	}, nil
+}
+
+// projectionMetrics are the columns projectReadings extrapolates
+var projectionMetrics = []string{"temperature", "humidity", "pressure", "gas_resistance", "aqi"}
+
+// projectReadings fits a straight line to each metric over the last window and
+// extends it ahead from the newest reading. This is a trivial linear projection
+// for dashboards, not a forecast: it knows nothing about daily cycles or weather,
+// and r_squared only says how straight the recent data was. Metrics with fewer
+// than two values in the window are null; the result is nil when the window
+// holds fewer than two readings.
+func projectReadings(ctx context.Context, db *sql.DB, shards *shardStore, window, ahead time.Duration, decimals int) (map[string]interface{}, error) {
+	end := time.Now().UTC()
+	start := end.Add(-window)
+	conn, table, release, err := shards.readConn(ctx, db, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := conn.QueryContext(ctx, `SELECT `+recordColumns+` FROM `+table+`
+		WHERE timestamp >= ? AND timestamp <= ? ORDER BY timestamp ASC`,
+		start.Format(time.RFC3339), end.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// x is hours since the window start, per metric since nullable columns
+	// have their own samples
+	xs := make([][]float64, len(projectionMetrics))
+	ys := make([][]float64, len(projectionMetrics))
+	var last time.Time
+	samples := 0
+	for rows.Next() {
+		rec, err := scanReading(rows)
+		if err != nil {
+			log.Printf("Row scan error: %v", err)
+			continue
+		}
+		x := rec.Timestamp.Sub(start).Hours()
+		for i, metric := range projectionMetrics {
+			if v, ok := rec.metric(metric); ok {
+				xs[i] = append(xs[i], x)
+				ys[i] = append(ys[i], v)
+			}
+		}
+		last = rec.Timestamp
+		samples++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if samples < 2 {
+		return nil, nil
+	}
+
+	target := last.Add(ahead)
+	targetX := target.Sub(start).Hours()
+	projections := map[string]interface{}{}
+	for i, metric := range projectionMetrics {
+		if len(xs[i]) < 2 {
+			projections[metric] = nil
+			continue
+		}
+		slope, intercept, r2 := linearFit(xs[i], ys[i])
+		projections[metric] = map[string]interface{}{
+			"value":          roundTo(slope*targetX+intercept, decimals),
+			"current":        ys[i][len(ys[i])-1],
+			"slope_per_hour": roundTo(slope, decimals+2),
+			"r_squared":      roundTo(r2, 4),
+			"samples":        len(xs[i]),
+		}
+	}
+
+	return map[string]interface{}{
+		"minutes":      ahead.Minutes(),
+		"window":       window.String(),
+		"samples":      samples,
+		"based_on":     last.Format(time.RFC3339),
+		"projected_at": target.Format(time.RFC3339),
+		"projections":  projections,
+	}, nil
+}
+
+// histogram counts values into n equal-width buckets spanning [lo, hi]. The top
+// bucket includes hi; values outside the bounds are counted separately.
+func histogram(values []float64, n int, lo, hi float64) (buckets []map[string]interface{}, below, above int) {
+	width := (hi - lo) / float64(n)
+	counts := make([]int, n)
+	for _, v := range values {
+		switch {
+		case v < lo:
+			below++
+		case v > hi:
+			above++
+		default:
+			i := int((v - lo) / width)
+			if i >= n {
+				i = n - 1
+			}
+			counts[i]++
+		}
+	}
+
+	buckets = make([]map[string]interface{}, n)
+	for i := range counts {
+		buckets[i] = map[string]interface{}{
+			"lower": lo + float64(i)*width,
+			"upper": lo + float64(i+1)*width,
+			"count": counts[i],
+		}
+	}
+	return buckets, below, above
+}
+
+// writeValidationErrors writes a 400 JSON response listing every validation failure
+func writeValidationErrors(w http.ResponseWriter, errs []ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "error",
+		"error":  "Validation failed",
+		"errors": errs,
+	})
+}
+
+// writeJSONError writes a JSON error body with the given status code
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"status": "error", "error": message})
+}
+
+// writeDBError logs a failed query and responds 504 with a JSON error when it
+// ran past the request's query deadline, otherwise 500 with the error text
+func writeDBError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		logf(r, "Query timed out: %v", err)
+		writeJSONError(w, http.StatusGatewayTimeout, "Query timed out")
+		return
+	}
+	logf(r, "Database error: %v", err)
+	http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
+}
+
+// apiPrefixes are path prefixes that belong to the API rather than static files
+var apiPrefixes = []string{"/temp", "/pressure/", "/events", "/baseline", "/health", "/export/", "/import/", "/admin/", "/dashboard/", "/locations", "/calibration", "/version", "/openapi.json", "/api/"}
+
+func isAPIPath(p string) bool {
+	for _, prefix := range apiPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedStaticSuffixes are file types never served, even if present in the static directory
+var blockedStaticSuffixes = []string{".db", ".db-wal", ".db-shm", ".db-journal", ".go"}
+
+// isBlockedStaticPath reports whether p names a database file, Go source, or
+// anything under a dotfile/dot-directory such as .git or .env
+func isBlockedStaticPath(p string) bool {
+	for _, segment := range strings.Split(path.Clean("/"+p), "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	lower := strings.ToLower(p)
+	for _, suffix := range blockedStaticSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// staticHandler serves files from dir. Unknown API-looking paths get a JSON 404,
+// sensitive files get a plain 404, and in SPA mode other missing GET paths fall
+// back to index.html.
+func staticHandler(dir string, spaMode bool) http.Handler {
+	fs := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAPIPath(r.URL.Path) {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Endpoint not found: %s %s", r.Method, r.URL.Path))
+			return
+		}
+		if isBlockedStaticPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if spaMode && r.Method == http.MethodGet {
+			name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+			if _, err := os.Stat(name); os.IsNotExist(err) {
+				http.ServeFile(w, r, filepath.Join(dir, "index.html"))
+				return
+			}
+		}
+
+		fs.ServeHTTP(w, r)
+	})
+}
+
+// pathWithin reports whether file lies inside dir, after resolving both to
+// absolute paths
+func pathWithin(file, dir string) (bool, error) {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return false, err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(absDir, absFile)
+	if err != nil {
+		return false, err
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// envInt reads an integer env var, falling back to def when unset or invalid
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Warning: Invalid %s %q, using default %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// requestIDKey is the context key holding the request ID
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID attached by logRequests, or "" outside a request
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf logs like log.Printf, prefixed with the request's ID
+func logf(r *http.Request, format string, args ...interface{}) {
+	log.Printf("[%s] "+format, append([]interface{}{requestIDFrom(r.Context())}, args...)...)
+}
+
+// validRequestID accepts short client-supplied IDs made of safe characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 16-byte hex ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder captures the response status for request logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Flush keeps streaming responses such as /events working through the wrapper
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// logRequests tags each request with an ID (honoring a valid incoming
+// X-Request-ID), echoes it in the response and logs the completed request
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		logf(r, "%s %s %d %s", r.Method, r.URL.RequestURI(), rec.status, time.Since(start).Round(time.Microsecond))
+	})
+}
+
+// recoverPanics turns a panicking handler into a logged 500 JSON error so one
+// bad request cannot take the server down. http.ErrAbortHandler is passed on,
+// since net/http uses it to abort a response deliberately.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			logf(r, "Panic serving %s %s: %v\n%s", r.Method, r.URL.RequestURI(), err, debug.Stack())
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessEntry is one request recorded in the api_access table
+type accessEntry struct {
+	at       time.Time
+	method   string
+	endpoint string
+	status   int
+	duration time.Duration
+}
+
+// accessLogBatch is the most entries written in one transaction
+const accessLogBatch = 200
+
+// accessLog records API usage in the api_access table off the request path.
+// Entries are buffered and written in batches by run; when the buffer is full
+// they are dropped and counted, so logging never slows a response.
+type accessLog struct {
+	entries chan accessEntry
+	every   uint64 // record one in every requests
+	seen    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+func newAccessLog(every int) *accessLog {
+	if every < 1 {
+		every = 1
+	}
+	return &accessLog{entries: make(chan accessEntry, 1024), every: uint64(every)}
+}
+
+// wrap records the requests handled by next; a nil log records nothing. The
+// endpoint is the matched route pattern, so /temp/{id} is one endpoint.
+func (a *accessLog) wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if a.seen.Add(1)%a.every != 0 {
+			return
+		}
+
+		_, endpoint := http.DefaultServeMux.Handler(r)
+		entry := accessEntry{at: start.UTC(), method: r.Method, endpoint: endpoint, status: rec.status, duration: time.Since(start)}
+		select {
+		case a.entries <- entry:
+		default:
+			a.dropped.Add(1)
+		}
+	})
+}
+
+// run writes buffered entries to db through the write queue, batching
+// whatever has accumulated, until ctx is cancelled
+func (a *accessLog) run(ctx context.Context, db *sql.DB, writes *writeQueue) {
+	for {
+		var batch []accessEntry
+		select {
+		case <-ctx.Done():
+			return
+		case entry := <-a.entries:
+			batch = append(batch, entry)
+		}
+	drain:
+		for len(batch) < accessLogBatch {
+			select {
+			case entry := <-a.entries:
+				batch = append(batch, entry)
+			default:
+				break drain
+			}
+		}
+
+		err := writes.transaction(ctx, db, func(tx *sql.Tx) error {
+			for _, e := range batch {
+				if _, err := tx.Exec(`INSERT INTO api_access (timestamp, method, endpoint, status, duration_ms) VALUES (?, ?, ?, ?, ?)`,
+					e.at.Format(time.RFC3339), e.method, e.endpoint, e.status, float64(e.duration.Microseconds())/1000); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Warning: Failed to write %d access log entries: %v", len(batch), err)
+		}
+	}
+}
+
+// startupGate answers 503 with Retry-After for everything except /health
+// until ready is set
+func startupGate(ready *atomic.Bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() && r.URL.Path != "/health" {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Server is starting, please retry", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// longRunningPaths stream or copy data for as long as they need and are
+// exempt from the query deadline; client disconnects still cancel them
+var longRunningPaths = []string{"/events", "/tempget/range", "/tempdaterange/parquet", "/export/db", "/import/csv"}
+
+// queryDeadline bounds each request's context, and with it every database
+// query run on it, by timeout. A zero timeout disables the deadline.
+func queryDeadline(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Slow-query warnings name the endpoint the query ran for
+		ctx := context.WithValue(r.Context(), queryEndpointKey{}, r.Method+" "+r.URL.Path)
+		if timeout <= 0 || slices.Contains(longRunningPaths, r.URL.Path) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// sqliteDriver is the driver every database is opened with; main registers
+// one with registerSQLFunctions, or a timedDriver when SLOW_QUERY_MS is set
+var sqliteDriver = "sqlite3"
+
+// queryEndpointKey is the context key naming the request a query runs for
+type queryEndpointKey struct{}
+
+// timedDriver wraps the SQLite driver so that every query and statement run
+// on its connections is timed, warning about those slower than threshold
+type timedDriver struct {
+	sqlite3.SQLiteDriver
+	threshold time.Duration
+}
+
+func (d *timedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{SQLiteConn: conn.(*sqlite3.SQLiteConn), threshold: d.threshold}, nil
+}
+
+// timedConn keeps every SQLiteConn method and times ExecContext and
+// QueryContext, which database/sql uses for all unprepared statements
+type timedConn struct {
+	*sqlite3.SQLiteConn
+	threshold time.Duration
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	c.check(ctx, time.Since(start), query, args)
+	return res, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	if err != nil {
+		c.check(ctx, time.Since(start), query, args)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, conn: c, ctx: ctx, query: query, args: args, elapsed: time.Since(start)}, nil
+}
+
+// timedRows adds up the time spent in the driver fetching rows, leaving out
+// time the caller spends between rows, such as streaming them to a client
+type timedRows struct {
+	driver.Rows
+	conn    *timedConn
+	ctx     context.Context
+	query   string
+	args    []driver.NamedValue
+	elapsed time.Duration
+}
+
+func (r *timedRows) Next(dest []driver.Value) error {
+	start := time.Now()
+	err := r.Rows.Next(dest)
+	r.elapsed += time.Since(start)
+	return err
+}
+
+func (r *timedRows) Close() error {
+	err := r.Rows.Close()
+	r.conn.check(r.ctx, r.elapsed, r.query, r.args)
+	return err
+}
+
+// check logs a query that took at least the threshold, with the endpoint it
+// ran for and its arguments, which carry the queried time bounds
+func (c *timedConn) check(ctx context.Context, elapsed time.Duration, query string, args []driver.NamedValue) {
+	if elapsed < c.threshold {
+		return
+	}
+	endpoint, _ := ctx.Value(queryEndpointKey{}).(string)
+	if endpoint == "" {
+		endpoint = "background"
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > 300 {
+		query = query[:300] + "..."
+	}
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = fmt.Sprint(arg.Value)
+		if len(values[i]) > 64 {
+			values[i] = values[i][:64] + "..."
+		}
+	}
+	log.Printf("[%s] Slow query (%s, %s): %s; args [%s]", requestIDFrom(ctx), elapsed.Round(time.Millisecond), endpoint, query, strings.Join(values, ", "))
+}
+
+// envelopeRecorder buffers a response so it can be wrapped in an envelope
+type envelopeRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (e *envelopeRecorder) WriteHeader(code int) {
+	e.status = code
+}
+
+func (e *envelopeRecorder) Write(b []byte) (int, error) {
+	return e.body.Write(b)
+}
+
+// envelope wraps successful JSON responses in {data, timestamp, meta} when
+// the request carries ?envelope=true. Errors, non-JSON bodies and the
+// long-running endpoints are passed through unchanged.
+func envelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("envelope") != "true" || slices.Contains(longRunningPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &envelopeRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		var data json.RawMessage
+		isJSON := strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+		if rec.status < 200 || rec.status >= 300 || !isJSON || json.Unmarshal(rec.body.Bytes(), &data) != nil {
+			w.WriteHeader(rec.status)
+			w.Write(rec.body.Bytes())
+			return
+		}
+
+		meta := map[string]interface{}{"path": r.URL.Path, "request_id": requestIDFrom(r.Context())}
+		var list []json.RawMessage
+		if json.Unmarshal(data, &list) == nil && list != nil {
+			meta["count"] = len(list)
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data":      data,
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+			"meta":      meta,
+		})
+	})
+}
+
+// prettyJSON re-indents JSON responses with two spaces when the request
+// carries ?pretty=true; responses are compact otherwise. Non-JSON bodies and
+// the long-running endpoints are passed through unchanged.
+func prettyJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("pretty") != "true" || slices.Contains(longRunningPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &envelopeRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		var indented bytes.Buffer
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") ||
+			json.Indent(&indented, rec.body.Bytes(), "", "  ") != nil {
+			w.WriteHeader(rec.status)
+			w.Write(rec.body.Bytes())
+			return
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.status)
+		w.Write(indented.Bytes())
+	})
+}
+
+// webhookClient is used for outgoing alert and mirror requests
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// postJSON POSTs payload as JSON to url and fails on non-2xx responses
+func postJSON(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// readingMirror forwards stored readings to a second service (MIRROR_URL)
+// from a background worker. The queue is bounded and enqueue never blocks, so
+// a slow or failing mirror cannot delay or fail /temprec; overflow is dropped.
+type readingMirror struct {
+	url     string
+	retries int
+	backoff time.Duration
+	queue   chan SensorData
+}
+
+func newReadingMirror(url string, depth, retries int) *readingMirror {
+	depth = max(depth, 1)
+	retries = max(retries, 0)
+	return &readingMirror{url: url, retries: retries, backoff: time.Second, queue: make(chan SensorData, depth)}
+}
+
+// enqueue queues data for forwarding; a nil mirror forwards nothing
+func (m *readingMirror) enqueue(data SensorData) {
+	if m == nil {
+		return
+	}
+	select {
+	case m.queue <- data:
+	default:
+		log.Printf("Warning: Mirror queue full, dropping reading at %s", data.Timestamp)
+	}
+}
+
+// run POSTs queued readings until ctx is cancelled, retrying a failed POST
+// up to retries times with doubling delays before logging and dropping it
+func (m *readingMirror) run(ctx context.Context) {
+	for {
+		var data SensorData
+		select {
+		case <-ctx.Done():
+			return
+		case data = <-m.queue:
+		}
+
+		delay := m.backoff
+		for attempt := 1; ; attempt++ {
+			err := postJSON(ctx, m.url, data)
+			if err == nil {
+				break
+			}
+			if attempt > m.retries || ctx.Err() != nil {
+				log.Printf("Warning: Failed to mirror reading at %s after %d attempts: %v", data.Timestamp, attempt, err)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+}
+
+// watchSensorLiveness checks the newest reading per location every interval and
+// alerts once when a location has been silent for longer than threshold. The
+// alert is logged and, when webhookURL is set, POSTed as JSON. It returns when
+// ctx is cancelled.
+func watchSensorLiveness(ctx context.Context, db *sql.DB, shards *shardStore, interval, threshold time.Duration, webhookURL string) {
+	alerted := make(map[string]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		seen, err := lastSeenByLocation(ctx, db, shards)
+		if err != nil {
+			log.Printf("Liveness check error: %v", err)
+			continue
+		}
+
+		now := time.Now().UTC()
+		for _, s := range seen {
+			location, lastSeen := s.location, s.at
+			key := location.String
+			silentFor := now.Sub(lastSeen)
+			if silentFor <= threshold {
+				if alerted[key] {
+					log.Printf("Sensor at location %q is reporting again", key)
+					delete(alerted, key)
+				}
+				continue
+			}
+			if alerted[key] {
+				continue
+			}
+			alerted[key] = true
+
+			log.Printf("Warning: No data from location %q since %s (%v)", key, lastSeen.Format(time.RFC3339), silentFor.Round(time.Second))
+			if webhookURL != "" {
+				alert := map[string]interface{}{
+					"alert":      "sensor_offline",
+					"location":   nil,
+					"last_seen":  lastSeen.Format(time.RFC3339),
+					"silent_for": silentFor.Round(time.Second).String(),
+					"threshold":  threshold.String(),
+				}
+				if location.Valid {
+					alert["location"] = location.String
+				}
+				if err := postJSON(ctx, webhookURL, alert); err != nil {
+					log.Printf("Warning: Failed to send liveness alert: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// locationSeen is when a location (null for readings without one) last reported
+type locationSeen struct {
+	location sql.NullString
+	at       time.Time
+}
+
+// lastSeenByLocation returns the newest reading time of every location. A
+// shard holds one month, so the newest shard a location appears in has its
+// latest reading.
+func lastSeenByLocation(ctx context.Context, db *sql.DB, shards *shardStore) ([]locationSeen, error) {
+	var seen []locationSeen
+	found := map[sql.NullString]bool{}
+	err := shards.each(db, false, func(db *sql.DB, _ time.Time) (bool, error) {
+		rows, err := db.QueryContext(ctx, `SELECT location, MAX(timestamp) FROM temp GROUP BY location`)
+		if err != nil {
+			return false, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var location sql.NullString
+			var lastSeenStr string
+			if err := rows.Scan(&location, &lastSeenStr); err != nil {
+				log.Printf("Row scan error: %v", err)
+				continue
+			}
+			if found[location] {
+				continue
+			}
+			at, err := time.Parse(time.RFC3339, lastSeenStr)
+			if err != nil {
+				log.Printf("Timestamp parse error: %v", err)
+				continue
+			}
+			found[location] = true
+			seen = append(seen, locationSeen{location: location, at: at})
+		}
+		return true, rows.Err()
+	})
+	return seen, err
+}
+
+// insertThrottle keeps at most one reading per location per interval
+// (MIN_INSERT_INTERVAL), tracking the last accepted arrival time in memory
+type insertThrottle struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// allow reports whether a reading for location arriving at now may be stored,
+// and if so records now as the location's last insert. undo restores the
+// previous time for when the insert then fails. A zero interval allows all.
+func (t *insertThrottle) allow(location string, now time.Time) (ok bool, undo func()) {
+	if t.interval <= 0 {
+		return true, func() {}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, seen := t.last[location]
+	if seen && now.Sub(prev) < t.interval {
+		return false, nil
+	}
+	t.last[location] = now
+	return true, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.last[location].Equal(now) {
+			if seen {
+				t.last[location] = prev
+			} else {
+				delete(t.last, location)
+			}
+		}
+	}
+}
+
+// thresholdAlerter raises alerts when a reading crosses a configured limit.
+// Each metric/location pair alerts only when it moves from normal to breached,
+// and at most once per cooldown, so a sustained breach doesn't repeat alerts.
+type thresholdAlerter struct {
+	mu       sync.Mutex
+	limits   map[string]float64 // metric -> maximum allowed value
+	cooldown time.Duration
+	webhook  string
+	breached map[string]bool
+	lastSent map[string]time.Time
+}
+
+func newThresholdAlerter(limits map[string]float64, cooldown time.Duration, webhook string) *thresholdAlerter {
+	return &thresholdAlerter{
+		limits:   limits,
+		cooldown: cooldown,
+		webhook:  webhook,
+		breached: make(map[string]bool),
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+// check compares values (metric -> value) against the limits and fires alerts on crossings
+func (a *thresholdAlerter) check(location string, values map[string]float64, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for metric, limit := range a.limits {
+		value, ok := values[metric]
+		if !ok {
+			continue
+		}
+		key := metric + "|" + location
+		if value <= limit {
+			a.breached[key] = false
+			continue
+		}
+		if a.breached[key] {
+			continue
+		}
+		a.breached[key] = true
+		if at.Sub(a.lastSent[key]) < a.cooldown {
+			continue
+		}
+		a.lastSent[key] = at
+
+		alert := map[string]interface{}{
+			"alert":     "threshold_exceeded",
+			"metric":    metric,
+			"value":     value,
+			"limit":     limit,
+			"location":  location,
+			"timestamp": at.Format(time.RFC3339),
+		}
+		if payload, err := json.Marshal(alert); err == nil {
+			log.Printf("ALERT %s", payload)
+		}
+		if a.webhook != "" {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+				defer cancel()
+				if err := postJSON(ctx, a.webhook, alert); err != nil {
+					log.Printf("Warning: Failed to send threshold alert: %v", err)
+				}
+			}()
+		}
+	}
+}
+
+// errQueueFull is returned by writeQueue.insert when no slot is free
+var errQueueFull = errors.New("write queue is full")
+
+// insertJob is a single reading, or a bulk transaction, waiting for the writer goroutine
+type insertJob struct {
+	db     *sql.DB // Database to write to: the main file or a monthly shard
+	args   []interface{}
+	tx     func(*sql.Tx) error // Set for bulk jobs run in one transaction instead of args
+	result chan error
+}
+
+// createTableSQL creates the readings table (with gas_resistance and aqi
+// columns for BME680) in the main database or a monthly shard
+const createTableSQL = `CREATE TABLE IF NOT EXISTS temp (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	temperature REAL NOT NULL,
+	humidity REAL NOT NULL,
+	pressure REAL NOT NULL,
+	gas_resistance INTEGER,
+	aqi INTEGER,
+	location TEXT,
+	timestamp DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	wind_speed REAL,
+	wind_direction REAL,
+	rainfall REAL,
+	warmup INTEGER NOT NULL DEFAULT 0,
+	note TEXT,
+	altitude REAL
+);`
+
+// readingColumns lists every temp column, so shards can be unioned by name
+const readingColumns = `id, temperature, humidity, pressure, gas_resistance, aqi, location, timestamp, ` + windRainColumns + `, warmup, note, altitude`
+
+// insertColumns are the temp columns every insert sets; optional ones such
+// as derivedColumns follow them, and insert args follow the column order
+var insertColumns = []string{"temperature", "humidity", "pressure", "gas_resistance", "aqi", "location", "timestamp",
+	"wind_speed", "wind_direction", "rainfall", "warmup", "note", "altitude"}
+
+// insertSQL returns a statement inserting one row into temp with a
+// placeholder for each of columns
+func insertSQL(columns []string) string {
+	return `INSERT INTO temp (` + strings.Join(columns, ", ") + `) VALUES (?` + strings.Repeat(", ?", len(columns)-1) + `)`
+}
+
+// serverTimeFormat is the /temprec server_time layout: RFC 3339 in UTC with
+// milliseconds, precise enough for a device to measure its clock drift
+const serverTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// writeQueue serializes inserts through a single writer goroutine so
+// concurrent posts never contend for the SQLite write lock
+type writeQueue struct {
+	jobs      chan insertJob
+	insertSQL string
+}
+
+func newWriteQueue(depth int, insertSQL string) *writeQueue {
+	return &writeQueue{jobs: make(chan insertJob, depth), insertSQL: insertSQL}
+}
+
+// run executes queued inserts in arrival order
+func (q *writeQueue) run() {
+	for job := range q.jobs {
+		if job.tx != nil {
+			job.result <- q.runTx(job.db, job.tx)
+			continue
+		}
+		_, err := job.db.Exec(q.insertSQL, job.args...)
+		job.result <- err
+	}
+}
+
+// runTx runs fn in a transaction on db, committing only if it succeeds
+func (q *writeQueue) runTx(db *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// transaction queues fn to run in a single transaction on db on the writer
+// goroutine, waiting for a free slot rather than failing fast like insert
+func (q *writeQueue) transaction(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) error {
+	job := insertJob{db: db, tx: fn, result: make(chan error, 1)}
+	select {
+	case q.jobs <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-job.result
+}
+
+// insert enqueues a reading for db and waits for the outcome, failing fast
+// with errQueueFull rather than blocking when the queue is at capacity
+func (q *writeQueue) insert(db *sql.DB, args ...interface{}) error {
+	job := insertJob{db: db, args: args, result: make(chan error, 1)}
+	select {
+	case q.jobs <- job:
+	default:
+		return errQueueFull
+	}
+	return <-job.result
+}
+
+// ensureLocationIndex creates the composite (location, timestamp) index used
+// by queries filtering on both, if the temp table of db has a location column
+// and the index is missing. Creation scans the whole table, so it is timed
+// and logged.
+func ensureLocationIndex(db *sql.DB) error {
+	var hasLocation, hasIndex bool
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('temp') WHERE name = 'location'`).Scan(&hasLocation); err != nil {
+		return err
+	}
+	if !hasLocation {
+		return nil
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_location_timestamp'`).Scan(&hasIndex); err != nil {
+		return err
+	}
+	if hasIndex {
+		return nil
+	}
+	start := time.Now()
+	if _, err := db.Exec(`CREATE INDEX idx_location_timestamp ON temp(location, timestamp);`); err != nil {
+		return err
+	}
+	log.Printf("Created index idx_location_timestamp in %v", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// addMissingColumn adds column with the given definition to the temp table of
+// db unless it already exists, reporting whether it was added
+func addMissingColumn(db *sql.DB, column, definition string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('temp') WHERE name=?`, column).Scan(&exists)
+	if err != nil || exists {
+		return false, err
+	}
+	if _, err := db.Exec(`ALTER TABLE temp ADD COLUMN ` + column + ` ` + definition); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// withoutWarmup narrows a table expression from readConn to readings not
+// flagged as taken during sensor warmup
+func withoutWarmup(table string) string {
+	return `(SELECT * FROM ` + table + ` WHERE warmup = 0)`
+}
+
+// maxAttachedShards is SQLite's default limit on attached databases, and so
+// the most monthly shards one range query can span
+const maxAttachedShards = 10
+
+// errTooManyShards is returned by shardStore.readConn for ranges spanning more
+// than maxAttachedShards months
+var errTooManyShards = fmt.Errorf("range spans more than %d monthly shards", maxAttachedShards)
+
+// shardStore keeps readings in one SQLite file per UTC month (SHARD_MODE=monthly),
+// named after DB_PATH: data.db becomes data_2024_03.db, data_2024_04.db, ...
+// A nil *shardStore means the default single-file mode.
+type shardStore struct {
+	dir    string
+	prefix string
+
+	mu  sync.Mutex
+	dbs map[string]*sql.DB // Shards opened so far, by file name
+}
+
+func newShardStore(dbPath string) *shardStore {
+	base := filepath.Base(dbPath)
+	return &shardStore{
+		dir:    filepath.Dir(dbPath),
+		prefix: strings.TrimSuffix(base, filepath.Ext(base)),
+		dbs:    map[string]*sql.DB{},
+	}
+}
+
+// name returns the schema name and file path of the shard holding month m
+func (s *shardStore) name(m time.Time) (schema, file string) {
+	schema = fmt.Sprintf("shard_%04d_%02d", m.Year(), int(m.Month()))
+	return schema, filepath.Join(s.dir, fmt.Sprintf("%s_%04d_%02d.db", s.prefix, m.Year(), int(m.Month())))
+}
+
+// files returns the existing shard files, oldest month first
+func (s *shardStore) files() ([]string, error) {
+	return filepath.Glob(filepath.Join(s.dir, s.prefix+"_[0-9][0-9][0-9][0-9]_[0-9][0-9].db"))
+}
+
+// month returns the month held by a shard file
+func (s *shardStore) month(file string) (time.Time, error) {
+	var year, month int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(filepath.Base(file), s.prefix+"_"), "%04d_%02d.db", &year, &month); err != nil {
+		return time.Time{}, fmt.Errorf("parsing shard name %s: %w", file, err)
+	}
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+// shardIDBits is how far a shard's month number is shifted to give the start
+// of its id sequence, so ids are unique across shards and name their shard
+const shardIDBits = 32
+
+// shardIDBase returns the id after which the shard for month m numbers its
+// readings
+func shardIDBase(m time.Time) int64 {
+	return int64(m.Year()*12+int(m.Month())-1) << shardIDBits
+}
+
+// seedIDs starts the id sequence of a shard file at its month's base.
+// Readings numbered from 1 by earlier versions are moved above the base.
+func seedIDs(db *sql.DB, month time.Time) (renumbered int64, err error) {
+	base := shardIDBase(month)
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE temp SET id = id + ? WHERE id < ?`, base, base)
+	if err != nil {
+		return 0, err
+	}
+	if renumbered, err = res.RowsAffected(); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE sqlite_sequence SET seq = seq + ? WHERE name = 'temp' AND seq < ?`, base, base); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO sqlite_sequence (name, seq) SELECT 'temp', ? WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = 'temp')`, base); err != nil {
+		return 0, err
+	}
+	return renumbered, tx.Commit()
+}
+
+// byID returns the database holding the reading with id: main in
+// single-file mode, otherwise the shard named by the id, or sql.ErrNoRows
+// when that shard does not exist
+func (s *shardStore) byID(main *sql.DB, id int64) (*sql.DB, error) {
+	if s == nil {
+		return main, nil
+	}
+	months := id >> shardIDBits
+	if id <= 0 || months == 0 {
+		return nil, sql.ErrNoRows
+	}
+	_, file := s.name(time.Date(int(months/12), time.Month(months%12+1), 1, 0, 0, 0, 0, time.UTC))
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, sql.ErrNoRows
+	}
+	return s.open(file)
+}
+
+// writeDB returns the database a reading taken at t belongs in: main itself in
+// single-file mode, otherwise that month's shard, created on first use
+func (s *shardStore) writeDB(main *sql.DB, t time.Time) (*sql.DB, error) {
+	if s == nil {
+		return main, nil
+	}
+	_, file := s.name(t.UTC())
+	return s.open(file)
+}
+
+// open returns the handle for a shard file, opening it and creating its
+// schema on first use
+func (s *shardStore) open(file string) (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if db, ok := s.dbs[file]; ok {
+		return db, nil
+	}
+	db, err := sql.Open(sqliteDriver, file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(createTableSQL); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating shard %s: %w", file, err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_timestamp ON temp(timestamp);`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating shard %s: %w", file, err)
+	}
+	if err := ensureLocationIndex(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating shard %s: %w", file, err)
+	}
+	month, err := s.month(file)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := seedIDs(db, month); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating shard %s: %w", file, err)
+	}
+	log.Printf("Opened shard %s", file)
+	s.dbs[file] = db
+	return db, nil
+}
+
+// migrate brings existing shard files up to the current schema, so they
+// can be unioned with newer ones by readingColumns
+func (s *shardStore) migrate() error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		db, err := sql.Open(sqliteDriver, file)
+		if err != nil {
+			return err
+		}
+		for _, col := range []struct{ name, definition string }{
+			{"warmup", "INTEGER NOT NULL DEFAULT 0"},
+			{"note", "TEXT"},
+			{"altitude", "REAL"},
+		} {
+			added, err := addMissingColumn(db, col.name, col.definition)
+			if err != nil {
+				db.Close()
+				return fmt.Errorf("migrating shard %s: %w", file, err)
+			}
+			if added {
+				log.Printf("Added %s column to shard %s", col.name, file)
+			}
+		}
+		if err := ensureLocationIndex(db); err != nil {
+			db.Close()
+			return fmt.Errorf("indexing shard %s: %w", file, err)
+		}
+		month, err := s.month(file)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		renumbered, err := seedIDs(db, month)
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("renumbering shard %s: %w", file, err)
+		}
+		if renumbered > 0 {
+			log.Printf("Renumbered %d readings in shard %s from id %d", renumbered, file, shardIDBase(month)+1)
+		}
+		db.Close()
+	}
+	return nil
+}
+
+// close closes every shard opened for writing
+func (s *shardStore) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, db := range s.dbs {
+		db.Close()
+	}
+}
+
+// readConn returns a connection on which table names every reading between
+// start and end: the temp table of main in single-file mode, otherwise a
+// UNION ALL over the existing monthly shards covering the range, ATTACHed to
+// the connection. release detaches them and returns the connection to the pool.
+func (s *shardStore) readConn(ctx context.Context, main *sql.DB, start, end time.Time) (conn *sql.Conn, table string, release func(), err error) {
+	// Every caller reads through the table expression, so tenant scoping
+	// applies to all of them
+	defer func() {
+		if err == nil {
+			table = scopeTable(ctx, table)
+		}
+	}()
+	conn, err = main.Conn(ctx)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if s == nil {
+		return conn, "temp", func() { conn.Close() }, nil
+	}
+
+	var attached []string
+	release = func() {
+		for _, schema := range attached {
+			if _, err := conn.ExecContext(context.Background(), `DETACH DATABASE `+schema); err != nil {
+				log.Printf("Warning: Failed to detach %s: %v", schema, err)
+			}
+		}
+		conn.Close()
+	}
+
+	var selects []string
+	first := time.Date(start.UTC().Year(), start.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	for m := first; !m.After(end); m = m.AddDate(0, 1, 0) {
+		schema, file := s.name(m)
+		if _, err := os.Stat(file); err != nil {
+			continue // No readings were ever written for that month
+		}
+		if len(attached) == maxAttachedShards {
+			release()
+			return nil, "", nil, errTooManyShards
+		}
+		if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS `+schema, file); err != nil {
+			release()
+			return nil, "", nil, err
+		}
+		attached = append(attached, schema)
+		selects = append(selects, `SELECT `+readingColumns+` FROM `+schema+`.temp`)
+	}
+
+	if len(selects) == 0 {
+		// The main table has the same columns and no rows in shard mode
+		return conn, `(SELECT ` + readingColumns + ` FROM main.temp WHERE 0)`, release, nil
+	}
+	return conn, `(` + strings.Join(selects, ` UNION ALL `) + `)`, release, nil
+}
+
+// each calls fn with main in single-file mode, otherwise with every existing
+// shard and the month it holds, newest first (oldest first with oldestFirst),
+// until fn returns false or an error. Queries not bounded by a time range
+// visit the shards this way instead of attaching them all to one connection.
+func (s *shardStore) each(main *sql.DB, oldestFirst bool, fn func(db *sql.DB, month time.Time) (bool, error)) error {
+	if s == nil {
+		_, err := fn(main, time.Time{})
+		return err
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	if !oldestFirst {
+		slices.Reverse(files)
+	}
+	for _, file := range files {
+		month, err := s.month(file)
+		if err != nil {
+			return err
+		}
+		db, err := s.open(file)
+		if err != nil {
+			return err
+		}
+		if more, err := fn(db, month); err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// newestFirst calls fn with main in single-file mode, otherwise with each
+// shard from the newest month back until fn returns anything but
+// sql.ErrNoRows, so the newest shard holding a matching row answers. It
+// returns sql.ErrNoRows when no shard has one.
+func (s *shardStore) newestFirst(main *sql.DB, fn func(db *sql.DB) error) error {
+	result := sql.ErrNoRows
+	err := s.each(main, false, func(db *sql.DB, _ time.Time) (bool, error) {
+		result = fn(db)
+		return errors.Is(result, sql.ErrNoRows), nil
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// firstMonth returns the month of the oldest shard file, if there is one
+func (s *shardStore) firstMonth() (time.Time, bool, error) {
+	if s == nil {
+		return time.Time{}, false, nil
+	}
+	files, err := s.files()
+	if err != nil || len(files) == 0 {
+		return time.Time{}, false, err
+	}
+	month, err := s.month(files[0])
+	return month, err == nil, err
+}
+
+// createHourlySummarySQL creates the hourly rollup tables. hourly_summary
+// holds one row per completed UTC hour and location (empty for readings without
+// one); hourly_summary_dirty lists hours whose readings changed after they
+// were rolled up, with a counter so a recompute can tell a newer change.
+const createHourlySummarySQL = `CREATE TABLE IF NOT EXISTS hourly_summary (
+	hour DATETIME NOT NULL,
+	location TEXT NOT NULL DEFAULT '',
+	count INTEGER NOT NULL,
+	first_timestamp DATETIME NOT NULL,
+	last_timestamp DATETIME NOT NULL,
+	min_temperature REAL,
+	max_temperature REAL,
+	avg_temperature REAL,
+	min_humidity REAL,
+	max_humidity REAL,
+	avg_humidity REAL,
+	min_pressure REAL,
+	max_pressure REAL,
+	avg_pressure REAL,
+	gas_resistance_count INTEGER NOT NULL,
+	min_gas_resistance INTEGER,
+	max_gas_resistance INTEGER,
+	avg_gas_resistance REAL,
+	aqi_count INTEGER NOT NULL,
+	min_aqi INTEGER,
+	max_aqi INTEGER,
+	avg_aqi REAL,
+	PRIMARY KEY (hour, location)
+);
+CREATE TABLE IF NOT EXISTS hourly_summary_dirty (
+	hour TEXT PRIMARY KEY,
+	marks INTEGER NOT NULL
+);`
+
+// summaryColumns lists the hourly_summary value columns, in the order
+// summaryAggregates computes them from readings
+const summaryColumns = `count, first_timestamp, last_timestamp,
+	min_temperature, max_temperature, avg_temperature,
+	min_humidity, max_humidity, avg_humidity,
+	min_pressure, max_pressure, avg_pressure,
+	gas_resistance_count, min_gas_resistance, max_gas_resistance, avg_gas_resistance,
+	aqi_count, min_aqi, max_aqi, avg_aqi`
+
+const summaryAggregates = `COUNT(*), MIN(timestamp), MAX(timestamp),
+	MIN(temperature), MAX(temperature), AVG(temperature),
+	MIN(humidity), MAX(humidity), AVG(humidity),
+	MIN(pressure), MAX(pressure), AVG(pressure),
+	COUNT(gas_resistance), MIN(gas_resistance), MAX(gas_resistance), AVG(gas_resistance),
+	COUNT(aqi), MIN(aqi), MAX(aqi), AVG(aqi)`
+
+// summaryHourFormat is the strftime format of an hourly_summary hour, the
+// RFC 3339 start of the hour a reading falls in
+const summaryHourFormat = `%Y-%m-%dT%H:00:00Z`
+
+// hourlyRollupSettle is how long after an hour ends it is rolled up, so
+// readings for it still being written are not missed
+const hourlyRollupSettle = time.Minute
+
+// hourlyRollup maintains hourly_summary in the background and tells queries
+// which hours they can read from it. Every hour before upTo has been rolled
+// up; changes to readings in completed hours are recorded by touch and
+// recomputed on the next run, and such hours are read raw until then.
+type hourlyRollup struct {
+	db      *sql.DB
+	shards  *shardStore
+	writes  *writeQueue
+	enabled bool
+	upTo    atomic.Int64 // Unix seconds, 0 until the first run
+}
+
+// run rolls up completed hours now and then every interval until ctx is cancelled
+func (h *hourlyRollup) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := h.rollUp(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: Hourly rollup failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollUp recomputes changed hours, then summarizes every hour completed
+// since the last run, a day at a time so a first backfill is incremental
+func (h *hourlyRollup) rollUp(ctx context.Context) error {
+	if h.upTo.Load() == 0 {
+		from, err := h.resume(ctx)
+		if err != nil {
+			return err
+		}
+		h.upTo.Store(from.Unix())
+	}
+
+	changed, err := h.recomputeDirty(ctx)
+	if err != nil {
+		return err
+	}
+
+	from := time.Unix(h.upTo.Load(), 0).UTC()
+	target := time.Now().UTC().Add(-hourlyRollupSettle).Truncate(time.Hour)
+	for start := from; start.Before(target); {
+		next := start.Add(24 * time.Hour)
+		if next.After(target) {
+			next = target
+		}
+		if err := h.recompute(ctx, start, next); err != nil {
+			return err
+		}
+		h.upTo.Store(next.Unix())
+		start = next
+	}
+	if changed > 0 || from.Before(target) {
+		log.Printf("Hourly rollup: summarized up to %s, recomputed %d changed hours", target.Format(time.RFC3339), changed)
+	}
+	return nil
+}
+
+// resume returns the hour rolling up continues from after a restart: the
+// one after the newest summary, else that of the oldest reading
+func (h *hourlyRollup) resume(ctx context.Context) (time.Time, error) {
+	var last sql.NullString
+	if err := h.db.QueryRowContext(ctx, `SELECT MAX(hour) FROM hourly_summary`).Scan(&last); err != nil {
+		return time.Time{}, err
+	}
+	if last.Valid {
+		t, err := time.Parse(time.RFC3339, last.String)
+		return t.Add(time.Hour), err
+	}
+
+	if month, ok, err := h.shards.firstMonth(); err != nil || ok {
+		return month, err
+	}
+	var first sql.NullString
+	if err := h.db.QueryRowContext(ctx, `SELECT MIN(timestamp) FROM temp`).Scan(&first); err != nil {
+		return time.Time{}, err
+	}
+	if !first.Valid {
+		return time.Now().UTC().Add(-hourlyRollupSettle).Truncate(time.Hour), nil
+	}
+	t, err := time.Parse(time.RFC3339, first.String)
+	return t.UTC().Truncate(time.Hour), err
+}
+
+// recomputeDirty recomputes the hours touch recorded, clearing each one
+// unless it was touched again meanwhile, and reports how many it did
+func (h *hourlyRollup) recomputeDirty(ctx context.Context) (int, error) {
+	rows, err := h.db.QueryContext(ctx, `SELECT hour, marks FROM hourly_summary_dirty ORDER BY hour`)
+	if err != nil {
+		return 0, err
+	}
+	type dirtyHour struct {
+		hour  string
+		marks int64
+	}
+	var dirty []dirtyHour
+	for rows.Next() {
+		var d dirtyHour
+		if err := rows.Scan(&d.hour, &d.marks); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		dirty = append(dirty, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, d := range dirty {
+		hour, err := time.Parse(time.RFC3339, d.hour)
+		if err != nil {
+			return i, err
+		}
+		if err := h.recompute(ctx, hour, hour.Add(time.Hour)); err != nil {
+			return i, err
+		}
+		err = h.writes.transaction(ctx, h.db, func(tx *sql.Tx) error {
+			_, err := tx.Exec(`DELETE FROM hourly_summary_dirty WHERE hour = ? AND marks = ?`, d.hour, d.marks)
+			return err
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(dirty), nil
+}
+
+// recompute replaces the summaries of the hours in [from, to) with ones
+// aggregated from the raw readings
+func (h *hourlyRollup) recompute(ctx context.Context, from, to time.Time) error {
+	conn, table, release, err := h.shards.readConn(ctx, h.db, from, to)
+	if err != nil {
+		return err
+	}
+	rows, err := conn.QueryContext(ctx, `SELECT strftime('`+summaryHourFormat+`', timestamp), COALESCE(location, ''), `+summaryAggregates+`
+		FROM `+table+`
+		WHERE timestamp >= ? AND timestamp < ?
+		GROUP BY 1, 2`, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		release()
+		return err
+	}
+	var summaries [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, 22)
+		dest := make([]interface{}, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			release()
+			return err
+		}
+		summaries = append(summaries, values)
+	}
+	rows.Close()
+	release()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return h.writes.transaction(ctx, h.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM hourly_summary WHERE hour >= ? AND hour < ?`, from.Format(time.RFC3339), to.Format(time.RFC3339)); err != nil {
+			return err
+		}
+		for _, values := range summaries {
+			if _, err := tx.Exec(`INSERT INTO hourly_summary (hour, location, `+summaryColumns+`)
+				VALUES (?`+strings.Repeat(", ?", len(values)-1)+`)`, values...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// touch records that readings taken at times were written, updated or
+// deleted. Hours that were already complete are marked for recomputing;
+// later ones are still to be rolled up anyway.
+func (h *hourlyRollup) touch(times ...time.Time) {
+	current := time.Now().UTC().Truncate(time.Hour)
+	var hours []string
+	seen := map[time.Time]bool{}
+	for _, t := range times {
+		hour := t.UTC().Truncate(time.Hour)
+		if !hour.Before(current) || seen[hour] {
+			continue
+		}
+		seen[hour] = true
+		hours = append(hours, hour.Format(time.RFC3339))
+	}
+	if len(hours) == 0 {
+		return
+	}
+
+	err := h.writes.transaction(context.Background(), h.db, func(tx *sql.Tx) error {
+		for _, hour := range hours {
+			if _, err := tx.Exec(`INSERT INTO hourly_summary_dirty (hour, marks) VALUES (?, 1)
+				ON CONFLICT(hour) DO UPDATE SET marks = marks + 1`, hour); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: Failed to mark %d hours for rollup: %v", len(hours), err)
+	}
+}
+
+// span returns the whole hours [from, to) within [start, end) that can be
+// read from hourly_summary on conn: rolled up and unchanged since. ok is
+// false when there are none or the rollup is disabled.
+func (h *hourlyRollup) span(ctx context.Context, conn *sql.Conn, start, end time.Time) (from, to time.Time, ok bool, err error) {
+	upTo := h.upTo.Load()
+	if !h.enabled || upTo == 0 {
+		return from, to, false, nil
+	}
+	from = start.UTC().Truncate(time.Hour)
+	if from.Before(start) {
+		from = from.Add(time.Hour)
+	}
+	to = end.UTC().Truncate(time.Hour)
+	if limit := time.Unix(upTo, 0).UTC(); limit.Before(to) {
+		to = limit
+	}
+	if !from.Before(to) {
+		return from, to, false, nil
+	}
+
+	var dirty sql.NullString
+	err = conn.QueryRowContext(ctx, `SELECT MIN(hour) FROM hourly_summary_dirty WHERE hour >= ? AND hour < ?`,
+		from.Format(time.RFC3339), to.Format(time.RFC3339)).Scan(&dirty)
+	if err != nil {
+		return from, to, false, err
+	}
+	if dirty.Valid {
+		if to, err = time.Parse(time.RFC3339, dirty.String); err != nil {
+			return from, to, false, err
+		}
+	}
+	return from, to, from.Before(to), nil
+}
+
+// hourlyPartials returns a table expression of per-hour summary rows, with
+// an hour column and summaryColumns, covering the readings of table in
+// [start, end) (or [start, end] with inclusiveEnd): hourly_summary rows for
+// the hours in [from, to) and raw aggregates for the remainder. Averages
+// combine as SUM(avg * count) / SUM(count).
+func hourlyPartials(ctx context.Context, table string, start, end, from, to time.Time, inclusiveEnd bool) (string, []interface{}) {
+	endOp := "<"
+	if inclusiveEnd {
+		endOp = "<="
+	}
+	expr := `(
+		SELECT hour, ` + summaryColumns + `
+		FROM ` + scopeTable(ctx, "hourly_summary") + `
+		WHERE hour >= ? AND hour < ?
+		UNION ALL
+		SELECT strftime('` + summaryHourFormat + `', timestamp), ` + summaryAggregates + `
+		FROM ` + table + `
+		WHERE timestamp >= ? AND timestamp ` + endOp + ` ? AND (timestamp < ? OR timestamp >= ?)
+		GROUP BY 1)`
+	f, t := from.Format(time.RFC3339), to.Format(time.RFC3339)
+	return expr, []interface{}{f, t, start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), f, t}
+}
+
+// latestCache holds the /temp response for the newest reading so polling
+// clients don't query the database on every request. Every write bumps the
+// version, so a reader that queried before the write cannot store a stale row.
+type latestCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	reading map[string]interface{}
+	stored  time.Time
+	version uint64
+}
+
+// get returns a copy of the cached reading if it is younger than the TTL,
+// otherwise the version to pass to set after querying the database
+func (c *latestCache) get() (map[string]interface{}, uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.reading == nil || time.Since(c.stored) > c.ttl {
+		return nil, c.version, false
+	}
+	return maps.Clone(c.reading), c.version, true
+}
+
+// set stores reading unless the cache was invalidated since version was read
+func (c *latestCache) set(reading map[string]interface{}, version uint64) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version != version {
+		return
+	}
+	c.reading = maps.Clone(reading)
+	c.stored = time.Now()
+}
+
+// invalidate drops the cached reading after an insert, update or delete
+func (c *latestCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reading = nil
+	c.version++
+}
+
+// idempotentResponse is a stored /temprec outcome, replayed for repeated keys
+type idempotentResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	done        bool // false while the first request is still running
+	expires     time.Time
+}
+
+// idempotencyKey scopes an Idempotency-Key to the API key that sent it, so
+// one tenant reusing another's key cannot replay that tenant's response
+type idempotencyKey struct {
+	apiKey string
+	key    string
+}
+
+// idempotencyStore remembers responses by Idempotency-Key for ttl so clients
+// can retry a POST without inserting the reading twice
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[idempotencyKey]*idempotentResponse
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{ttl: ttl, entries: make(map[idempotencyKey]*idempotentResponse)}
+}
+
+// evictExpired drops entries older than the TTL
+func (s *idempotencyStore) evictExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, e := range s.entries {
+		if e.done && now.After(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// responseCapture tees a response to the client while recording it
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(code int) {
+	c.status = code
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// wrap replays the stored response when a request repeats an Idempotency-Key
+// with the same API key. Server errors are not stored, so those requests can
+// be retried with the same key.
+func (s *idempotencyStore) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Idempotency-Key")
+		if header == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(header) > 255 {
+			http.Error(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+		key := idempotencyKey{apiKey: apiKeyFromRequest(r), key: header}
+
+		s.mu.Lock()
+		if e, ok := s.entries[key]; ok && (!e.done || time.Now().Before(e.expires)) {
+			s.mu.Unlock()
+			if !e.done {
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			}
+			w.Header().Set("Content-Type", e.contentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+		entry := &idempotentResponse{}
+		s.entries[key] = entry
+		s.mu.Unlock()
+
+		capture := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			// A panic or server error releases the key for a retry
+			if !completed || capture.status >= 500 {
+				delete(s.entries, key)
+				return
+			}
+			entry.status = capture.status
+			entry.contentType = capture.Header().Get("Content-Type")
+			entry.body = capture.body.Bytes()
+			entry.done = true
+			entry.expires = time.Now().Add(s.ttl)
+		}()
+		next(capture, r)
+		completed = true
+	}
+}
+
+// eventBroker fans out newly inserted readings to Server-Sent Events subscribers
+type eventBroker struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{clients: make(map[chan []byte]struct{})}
+}
+
+func (b *eventBroker) subscribe() chan []byte {
+	ch := make(chan []byte, 16)
+	b.mu.Lock()
+	b.clients[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan []byte) {
+	b.mu.Lock()
+	delete(b.clients, ch)
+	b.mu.Unlock()
+}
+
+// publish sends msg to every subscriber; slow clients with a full buffer miss the message
+func (b *eventBroker) publish(msg []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.clients {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+func main() {
+	// Process start, for /temp/uptime
+	startTime := time.Now()
+
+	// Cancelled on SIGINT/SIGTERM to stop background workers and the server
+	appCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Load configuration (config file, then env overrides)
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+	}
+	// Tenant keys are secrets; only their number is logged
+	logged := cfg
+	logged.TenantKeys = nil
+	if resolved, err := json.Marshal(logged); err == nil {
+		log.Printf("Config: %s", resolved)
+	}
+	if len(cfg.TenantKeys) > 0 {
+		log.Printf("Tenant API keys: %d; API requests require a key", len(cfg.TenantKeys))
+	}
+
+	// Set once migrations and startup work finish; until then requests get 503
+	var ready atomic.Bool
+
+	// Health check endpoint; reports "starting" with 503 until ready
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		status := "healthy"
+		w.Header().Set("Content-Type", "application/json")
+		if !ready.Load() {
+			status = "starting"
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": status,
+			"time":   time.Now().UTC().Format(time.RFC3339),
+		})
+	})
+
+	// API: Build metadata of the running binary
+	http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"version":    version,
+			"commit":     commit,
+			"build_time": buildTime,
+			"go_version": runtime.Version(),
+		})
+	})
+
+	// Server port from config (file or PORT env), default 8811
+	port := cfg.Port
+
+	// LISTEN_ADDR (host:port) takes precedence over PORT for binding to a specific
+	// interface; both were validated by loadConfig
+	addr := ":" + port
+	if cfg.ListenAddr != "" {
+		_, port, _ = net.SplitHostPort(cfg.ListenAddr)
+		addr = cfg.ListenAddr
+	}
+
+	// Database queries run on the request context, so QUERY_TIMEOUT bounds them
+	queryTimeout := envDuration("QUERY_TIMEOUT", 30*time.Second)
+
+	// ACCESS_LOG=true keeps a persistent api_access table of requests for
+	// /admin/usage, recording one in every ACCESS_LOG_SAMPLE (default all)
+	var access *accessLog
+	if os.Getenv("ACCESS_LOG") == "true" {
+		access = newAccessLog(envInt("ACCESS_LOG_SAMPLE", 1))
+		log.Printf("Access log: recording 1 in %d requests", access.every)
+	}
+
+	// Optional key required for modifying stored readings
+	writeAPIKey := os.Getenv("WRITE_API_KEY")
+
+	// Key required for admin endpoints; they are disabled when unset
+	adminAPIKey := os.Getenv("ADMIN_API_KEY")
+
+	// Tenant keys scope API requests to one location each
+	tenants := newTenantAuth(cfg.TenantKeys, adminAPIKey, writeAPIKey)
+
+	srv := &http.Server{Addr: addr, Handler: logRequests(recoverPanics(access.wrap(tenants.wrap(startupGate(&ready, queryDeadline(queryTimeout, prettyJSON(envelope(http.DefaultServeMux))))))))}
+
+	// Optional TLS: enabled when both TLS_CERT and TLS_KEY are set
+	var redirectSrv *http.Server
+	tlsCert := os.Getenv("TLS_CERT")
+	tlsKey := os.Getenv("TLS_KEY")
+	if tlsCert != "" || tlsKey != "" {
+		if tlsCert == "" || tlsKey == "" {
+			log.Fatal("Both TLS_CERT and TLS_KEY must be set to enable TLS")
+		}
+		for _, f := range []string{tlsCert, tlsKey} {
+			if _, err := os.Stat(f); err != nil {
+				log.Fatalf("TLS file not readable: %v", err)
+			}
+		}
+
+		// TLS_REDIRECT=true listens on :80 and redirects plain HTTP to HTTPS
+		if os.Getenv("TLS_REDIRECT") == "true" {
+			redirectSrv = &http.Server{Addr: ":80", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				host := r.Host
+				if h, _, err := net.SplitHostPort(r.Host); err == nil {
+					host = h
+				}
+				if port != "443" {
+					host = net.JoinHostPort(host, port)
+				}
+				http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+			})}
+			go func() {
+				log.Println("HTTP->HTTPS redirect listening on :80")
+				if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Printf("Warning: HTTP redirect listener failed: %v", err)
+				}
+			}()
+		}
+
+	}
+
+	// Shut down gracefully once a signal arrives
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-appCtx.Done()
+		log.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Warning: Shutdown error: %v", err)
+		}
+		if redirectSrv != nil {
+			if err := redirectSrv.Shutdown(ctx); err != nil {
+				log.Printf("Warning: HTTP redirect shutdown error: %v", err)
+			}
+		}
+	}()
+
+	// Listen before migrations run so load balancers see "starting" rather than
+	// connection errors; handlers are registered on the mux as startup proceeds
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsCert != "" {
+			log.Printf("Server starting on %s (HTTPS)...", addr)
+			log.Printf("Health check: https://localhost:%s/health", port)
+			serveErr <- srv.ServeTLS(ln, tlsCert, tlsKey)
+		} else {
+			log.Printf("Server starting on %s (HTTP)...", addr)
+			log.Printf("Health check: http://localhost:%s/health", port)
+			serveErr <- srv.Serve(ln)
+		}
+	}()
+
+	// Every connection gets the SQL functions scopeTable relies on
+	tenantLocations = tenants.locations
+	sql.Register("sqlite3_app", &sqlite3.SQLiteDriver{ConnectHook: registerSQLFunctions})
+	sqliteDriver = "sqlite3_app"
+
+	// SLOW_QUERY_MS logs every query that takes at least that long
+	if ms := envInt("SLOW_QUERY_MS", 0); ms > 0 {
+		sql.Register("sqlite3_timed", &timedDriver{
+			SQLiteDriver: sqlite3.SQLiteDriver{ConnectHook: registerSQLFunctions},
+			threshold:    time.Duration(ms) * time.Millisecond,
+		})
+		sqliteDriver = "sqlite3_timed"
+		log.Printf("Slow query log: queries taking %dms or more", ms)
+	}
+
+	// Open database connection. DB_PATH=:memory: would give every pooled
+	// connection its own empty database, so it uses a shared-cache one instead.
+	inMemory := cfg.DBPath == ":memory:"
+	dsn := cfg.DBPath
+	if inMemory {
+		dsn = "file::memory:?cache=shared"
+	}
+	db, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		log.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+
+	// Test database connection
+	if err := db.Ping(); err != nil {
+		log.Fatal("Failed to ping database:", err)
+	}
+
+	// A shared in-memory database is dropped when its last connection closes,
+	// so hold one open for the life of the process
+	if inMemory {
+		keepAlive, err := db.Conn(context.Background())
+		if err != nil {
+			log.Fatal("Failed to open in-memory database:", err)
+		}
+		defer keepAlive.Close()
+		log.Println("Using in-memory database; data is lost when the server stops")
+	} else {
+		// WAL lets readers run during writes; the mode is stored in the file
+		var journalMode string
+		if err := db.QueryRow(`PRAGMA journal_mode=WAL`).Scan(&journalMode); err != nil {
+			log.Fatal("Failed to enable WAL: ", err)
+		}
+		if journalMode != "wal" {
+			log.Printf("Warning: journal_mode is %s, not wal", journalMode)
+		}
+	}
+
+	// Create table if not exists (with gas_resistance and aqi columns for BME680)
+	_, err = db.Exec(createTableSQL)
+	if err != nil {
+		log.Fatal("Failed to create table:", err)
+	}
+
+	// Check and add gas_resistance column if it doesn't exist (for migration from old schema)
+	// SQLite doesn't support IF NOT EXISTS for ALTER TABLE, so we check first
+	var gasResistanceExists bool
+	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('temp') WHERE name='gas_resistance'`).Scan(&gasResistanceExists)
+	if err == nil && !gasResistanceExists {
+		_, err = db.Exec(`ALTER TABLE temp ADD COLUMN gas_resistance INTEGER;`)
+		if err != nil {
+			log.Printf("Warning: Failed to add gas_resistance column: %v", err)
+		} else {
+			log.Println("Added gas_resistance column to existing table")
+		}
+	}
+
+	// Check and add aqi column if it doesn't exist
+	var aqiExists bool
+	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('temp') WHERE name='aqi'`).Scan(&aqiExists)
+	if err == nil && !aqiExists {
+		_, err = db.Exec(`ALTER TABLE temp ADD COLUMN aqi INTEGER;`)
+		if err != nil {
+			log.Printf("Warning: Failed to add aqi column: %v", err)
+		} else {
+			log.Println("Added aqi column to existing table")
+		}
+	}
+
+	// Check and add location column if it doesn't exist
+	var locationExists bool
+	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('temp') WHERE name='location'`).Scan(&locationExists)
+	if err == nil && !locationExists {
+		_, err = db.Exec(`ALTER TABLE temp ADD COLUMN location TEXT;`)
+		if err != nil {
+			log.Printf("Warning: Failed to add location column: %v", err)
+		} else {
+			log.Println("Added location column to existing table")
+		}
+	}
+
+	// Check and add the wind and rain columns if they don't exist
+	for _, column := range []string{"wind_speed", "wind_direction", "rainfall"} {
+		var exists bool
+		err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('temp') WHERE name=?`, column).Scan(&exists)
+		if err == nil && !exists {
+			_, err = db.Exec(`ALTER TABLE temp ADD COLUMN ` + column + ` REAL;`)
+			if err != nil {
+				log.Printf("Warning: Failed to add %s column: %v", column, err)
+			} else {
+				log.Printf("Added %s column to existing table", column)
+			}
+		}
+	}
+
+	// Check and add the warmup flag column if it doesn't exist
+	if added, err := addMissingColumn(db, "warmup", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		log.Printf("Warning: Failed to add warmup column: %v", err)
+	} else if added {
+		log.Println("Added warmup column to existing table")
+	}
+
+	// Check and add the note column if it doesn't exist
+	if added, err := addMissingColumn(db, "note", "TEXT"); err != nil {
+		log.Printf("Warning: Failed to add note column: %v", err)
+	} else if added {
+		log.Println("Added note column to existing table")
+	}
+
+	// Check and add the altitude column if it doesn't exist
+	if added, err := addMissingColumn(db, "altitude", "REAL"); err != nil {
+		log.Printf("Warning: Failed to add altitude column: %v", err)
+	} else if added {
+		log.Println("Added altitude column to existing table")
+	}
+
+	// STORE_DERIVED=true adds and fills dew_point and absolute_humidity columns;
+	// without it the schema is left alone
+	storeDerived := os.Getenv("STORE_DERIVED") == "true"
+	if storeDerived {
+		for _, column := range derivedColumns {
+			var exists bool
+			err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('temp') WHERE name=?`, column).Scan(&exists)
+			if err == nil && !exists {
+				_, err = db.Exec(`ALTER TABLE temp ADD COLUMN ` + column + ` REAL;`)
+				if err != nil {
+					log.Fatalf("Failed to add %s column: %v", column, err)
+				}
+				log.Printf("Added %s column to existing table", column)
+			}
+		}
+	}
+
+	// STORE_CLOCK_SKEW=true adds a clock_skew column holding, for readings with
+	// a client-supplied timestamp, its offset from the server's clock in seconds
+	storeClockSkew := os.Getenv("STORE_CLOCK_SKEW") == "true"
+	if storeClockSkew {
+		if added, err := addMissingColumn(db, "clock_skew", "REAL"); err != nil {
+			log.Fatalf("Failed to add clock_skew column: %v", err)
+		} else if added {
+			log.Println("Added clock_skew column to existing table")
+		}
+	}
+
+	log.Println("Database schema verified and ready")
+
+	// Create index on timestamp for better query performance
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_timestamp ON temp(timestamp);`)
+	if err != nil {
+		log.Println("Warning: Failed to create index:", err)
+	}
+
+	// Composite index for queries filtering by location and time
+	if err := ensureLocationIndex(db); err != nil {
+		log.Println("Warning: Failed to create location index:", err)
+	}
+
+	// Table holding the persisted gas resistance baseline (single row)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS baseline (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		gas_resistance INTEGER NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal("Failed to create baseline table:", err)
+	}
+
+	// Per-request usage history, only kept with ACCESS_LOG=true
+	if access != nil {
+		_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_access (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp DATETIME NOT NULL,
+			method TEXT NOT NULL,
+			endpoint TEXT NOT NULL,
+			status INTEGER NOT NULL,
+			duration_ms REAL NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_api_access_timestamp ON api_access(timestamp);`)
+		if err != nil {
+			log.Fatal("Failed to create api_access table:", err)
+		}
+	}
+
+	// SHARD_MODE=monthly writes readings to one file per month next to DB_PATH
+	var shards *shardStore
+	switch mode := os.Getenv("SHARD_MODE"); mode {
+	case "", "single":
+	case "monthly":
+		if inMemory {
+			log.Fatal("SHARD_MODE=monthly needs a file DB_PATH, not :memory:")
+		}
+		if storeDerived {
+			log.Fatal("STORE_DERIVED=true is not supported with SHARD_MODE=monthly")
+		}
+		if storeClockSkew {
+			log.Fatal("STORE_CLOCK_SKEW=true is not supported with SHARD_MODE=monthly")
+		}
+		shards = newShardStore(cfg.DBPath)
+		defer shards.close()
+		if err := shards.migrate(); err != nil {
+			log.Fatal("Failed to migrate shards: ", err)
+		}
+		log.Printf("Shard mode: monthly files %s_YYYY_MM.db in %s", shards.prefix, shards.dir)
+	default:
+		log.Fatalf("Invalid SHARD_MODE %q (expected single or monthly)", mode)
+	}
+
+	// Gas baseline: moving maximum over BASELINE_WINDOW, recomputed every BASELINE_INTERVAL
+	baselineWindow := envDuration("BASELINE_WINDOW", 24*time.Hour)
+	baselineInterval := envDuration("BASELINE_INTERVAL", 5*time.Minute)
+	baseline := &gasBaseline{}
+	if err := baseline.load(db); err != nil {
+		log.Printf("Warning: Failed to load gas baseline: %v", err)
+	}
+	if err := baseline.recompute(db, shards, baselineWindow); err != nil {
+		log.Printf("Warning: Failed to compute gas baseline: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(baselineInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-appCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := baseline.recompute(db, shards, baselineWindow); err != nil {
+				log.Printf("Warning: Failed to compute gas baseline: %v", err)
+			}
+		}
+	}()
+
+	// Sensor liveness watcher, enabled by LIVENESS_THRESHOLD (e.g. "10m")
+	if os.Getenv("LIVENESS_THRESHOLD") != "" {
+		livenessThreshold := envDuration("LIVENESS_THRESHOLD", 10*time.Minute)
+		livenessInterval := envDuration("LIVENESS_INTERVAL", time.Minute)
+		alertWebhook := os.Getenv("ALERT_WEBHOOK")
+		log.Printf("Sensor liveness watcher: threshold=%v interval=%v webhook=%t", livenessThreshold, livenessInterval, alertWebhook != "")
+		go watchSensorLiveness(appCtx, db, shards, livenessInterval, livenessThreshold, alertWebhook)
+	}
+
+	// How far into the future a client-supplied reading timestamp may be
+	maxFutureSkew := envDuration("MAX_FUTURE_SKEW", 5*time.Minute)
+
+	// HUMIDITY_CLAMP=true clamps humidity and temperature slightly outside the
+	// valid range to the boundary instead of rejecting the reading
+	clamp := readingClamp{
+		enabled:           os.Getenv("HUMIDITY_CLAMP") == "true",
+		tempTolerance:     math.Abs(envFloat("TEMP_CLAMP_TOLERANCE", 0.5)),
+		humidityTolerance: math.Abs(envFloat("HUMIDITY_CLAMP_TOLERANCE", 1)),
+	}
+	if clamp.enabled {
+		log.Printf("Clamping readings within %g%% humidity and %g°C of the valid range", clamp.humidityTolerance, clamp.tempTolerance)
+	}
+
+	// Threshold alerts on insert (ALERT_AQI_MAX, ALERT_TEMP_MAX)
+	alertLimits := map[string]float64{}
+	if os.Getenv("ALERT_AQI_MAX") != "" {
+		alertLimits["aqi"] = envFloat("ALERT_AQI_MAX", 150)
+	}
+	if os.Getenv("ALERT_TEMP_MAX") != "" {
+		alertLimits["temperature"] = envFloat("ALERT_TEMP_MAX", 40)
+	}
+	alerter := newThresholdAlerter(alertLimits, envDuration("ALERT_COOLDOWN", 15*time.Minute), os.Getenv("ALERT_WEBHOOK"))
+
+	// MIRROR_URL receives a copy of every stored reading, POSTed in the background
+	var mirror *readingMirror
+	if mirrorURL := os.Getenv("MIRROR_URL"); mirrorURL != "" {
+		mirror = newReadingMirror(mirrorURL, envInt("MIRROR_QUEUE_SIZE", 100), envInt("MIRROR_RETRIES", 3))
+		log.Printf("Mirroring readings to %s (queue %d, %d retries)", mirrorURL, cap(mirror.queue), mirror.retries)
+		go mirror.run(appCtx)
+	}
+
+	// MIN_INSERT_INTERVAL (e.g. "1m") drops readings arriving sooner than that
+	// after the last stored one for the same location
+	throttle := &insertThrottle{last: map[string]time.Time{}}
+	if os.Getenv("MIN_INSERT_INTERVAL") != "" {
+		throttle.interval = envDuration("MIN_INSERT_INTERVAL", time.Minute)
+		log.Printf("Ingestion throttle: at most one reading per location every %v", throttle.interval)
+	}
+
+	// Default look-back window for /pressure/trend
+	pressureTrendWindow := envDuration("PRESSURE_TREND_WINDOW", 3*time.Hour)
+
+	// Reporting interval /tempstat measures coverage_fraction against
+	expectedInterval := envDuration("EXPECTED_INTERVAL", time.Minute)
+
+	// Longest interval one reading counts for in /tempstat/exposure
+	exposureMaxGap := envDuration("EXPOSURE_MAX_GAP", time.Hour)
+
+	// Default look-back window fitted by /temp/project
+	projectionWindow := envDuration("PROJECTION_WINDOW", 2*time.Hour)
+
+	// Defaults for /tempdaterange anomaly flagging
+	anomalyStdDev := envFloat("ANOMALY_STDDEV", 3)
+	anomalyWindow := envInt("ANOMALY_WINDOW", 20)
+
+	// Local timezone for daily statistics and CSV timestamps
+	localZone := cfg.localZone
+	log.Printf("Using timezone %s", localZone)
+
+	// Maximum size of a JSON request body
+	maxBodyBytes := int64(envInt("MAX_BODY_BYTES", 1<<20))
+
+	// Longest range /tempdaterange will load into memory, and the limit for
+	// the streaming /tempget/range export (0 = unlimited)
+	maxRangeDays := envInt("MAX_RANGE_DAYS", 90)
+	maxStreamRangeDays := envInt("MAX_STREAM_RANGE_DAYS", 0)
+
+	// Maximum size of a CSV upload to /import/csv
+	maxImportBytes := int64(envInt("MAX_IMPORT_BYTES", 64<<20))
+
+	// Idempotency-Key support for /temprec; expired keys are swept every minute
+	idempotency := newIdempotencyStore(envDuration("IDEMPOTENCY_TTL", 24*time.Hour))
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-appCtx.Done():
+				return
+			case now := <-ticker.C:
+				idempotency.evictExpired(now)
+			}
+		}
+	}()
+
+	// Sensor calibration offsets applied at ingestion
+	calibration := Calibration{
+		Temperature: envFloat("CALIBRATE_TEMPERATURE", 0),
+		Humidity:    envFloat("CALIBRATE_HUMIDITY", 0),
+		Pressure:    envFloat("CALIBRATE_PRESSURE", 0),
+	}
+	if calibration != (Calibration{}) {
+		log.Printf("Calibration offsets: temperature=%+.2f°C humidity=%+.2f%% pressure=%+.2fhPa",
+			calibration.Temperature, calibration.Humidity, calibration.Pressure)
+	}
+
+	// Broker for pushing new readings to /events subscribers
+	broker := newEventBroker()
+
+	// All inserts go through one writer goroutine; posts beyond the queue
+	// depth are rejected with 503
+	columns := slices.Clone(insertColumns)
+	if storeDerived {
+		columns = append(columns, derivedColumns...)
+	}
+	if storeClockSkew {
+		columns = append(columns, "clock_skew")
+	}
+	insertReading := insertSQL(columns)
+	writes := newWriteQueue(envInt("WRITE_QUEUE_DEPTH", 256), insertReading)
+	go writes.run()
+	if access != nil {
+		go access.run(appCtx, db, writes)
+	}
+
+	// Hourly summaries, kept by a background job with HOURLY_ROLLUP=true and
+	// read by hourly-or-coarser queries. Changed hours are tracked even while
+	// it is off, so enabling it later never serves stale summaries.
+	if _, err := db.Exec(createHourlySummarySQL); err != nil {
+		log.Fatal("Failed to create hourly_summary table:", err)
+	}
+	rollup := &hourlyRollup{db: db, shards: shards, writes: writes, enabled: os.Getenv("HOURLY_ROLLUP") == "true"}
+	if rollup.enabled {
+		rollupInterval := envDuration("HOURLY_ROLLUP_INTERVAL", 5*time.Minute)
+		log.Printf("Hourly rollup every %v", rollupInterval)
+		go rollup.run(appCtx, rollupInterval)
+	}
+
+	// In-memory copy of the latest reading for /temp; LATEST_CACHE_TTL=0 disables it
+	latest := &latestCache{ttl: envDuration("LATEST_CACHE_TTL", 5*time.Second)}
+
+	// Serve static files from STATIC_DIR (SPA_MODE=true serves index.html for unknown non-API routes)
+	staticDir := os.Getenv("STATIC_DIR")
+	if staticDir == "" {
+		staticDir = "./static"
+	}
+	if within, err := pathWithin(cfg.DBPath, staticDir); err == nil && within {
+		log.Printf("Warning: database %s is inside STATIC_DIR %s and may be downloadable; move one of them", cfg.DBPath, staticDir)
+	}
+	spaMode := os.Getenv("SPA_MODE") == "true"
+	http.Handle("/", staticHandler(staticDir, spaMode))
+
+	// decodeReading decodes and validates a /temprec body, shared with
+	// /temprec/validate so the two can't drift. It writes the error response
+	// and returns false when the reading would be rejected.
+	decodeReading := func(w http.ResponseWriter, r *http.Request) (SensorData, time.Time, bool) {
+		var data SensorData
+		if !decodeJSONBody(w, r, &data, maxBodyBytes) {
+			return data, time.Time{}, false
+		}
+
+		// Convert to Celsius/hPa and apply calibration so validation applies to
+		// the corrected values that get stored, reporting every failure at once
+		errs := data.normalizeUnits()
+
+		// A tenant key records readings for its own location only
+		if tenant, ok := tenantLocation(r.Context()); ok {
+			if data.Location != nil && *data.Location != "" && *data.Location != tenant {
+				errs = append(errs, ValidationError{Field: "location", Message: fmt.Sprintf("API key is bound to location %q", tenant)})
+			}
+			data.Location = &tenant
+		}
+
+		if len(errs) == 0 {
+			calibration.apply(&data)
+			location := ""
+			if data.Location != nil {
+				location = *data.Location
+			}
+			ranges := cfg.rangesFor(location)
+			if clamped := clamp.apply(&data, ranges); len(clamped) > 0 {
+				logf(r, "Clamped reading: %s", strings.Join(clamped, ", "))
+			}
+			errs = data.validate(ranges)
+		}
+
+		// Store the client-supplied reading time, or the current time, in UTC
+		utc, tsErrs := data.readingTime(time.Now(), maxFutureSkew)
+		errs = append(errs, tsErrs...)
+
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return data, utc, false
+		}
+		return data, utc, true
+	}
+
+	// API: Check a /temprec payload without storing it
+	http.HandleFunc("/temprec/validate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, _, ok := decodeReading(w, r); !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"valid": true})
+	})
+
+	// API: Record sensor data
+	http.HandleFunc("/temprec", idempotency.wrap(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Reported back as server_time so devices can correct their clocks
+		received := time.Now().UTC()
+
+		data, utc, ok := decodeReading(w, r)
+		if !ok {
+			return
+		}
+
+		// Validation ran on the original values; store them rounded
+		data.Temperature = roundTo(data.Temperature, cfg.RoundDecimals)
+		data.Humidity = roundTo(data.Humidity, cfg.RoundDecimals)
+		data.Pressure = roundTo(data.Pressure, cfg.RoundDecimals)
+
+		// Insert data into database
+		var gasResistance *int
+		if data.GasResistance != nil && *data.GasResistance > 0 {
+			gasResistance = data.GasResistance
+		}
+
+		// Derive AQI from the gas baseline when the sensor didn't send one
+		if data.AQI == nil && gasResistance != nil {
+			base, _ := baseline.get()
+			if aqi, ok := computeAQI(*gasResistance, base); ok {
+				data.AQI = &aqi
+			}
+		}
+
+		// Treat an empty location the same as no location
+		var location *string
+		if data.Location != nil && *data.Location != "" {
+			location = data.Location
+		}
+
+		// Readings without their own altitude are taken at the station's
+		altitude := data.Altitude
+		if altitude == nil {
+			altitude = cfg.StationAltitude
+		}
+
+		throttleKey := ""
+		if location != nil {
+			throttleKey = *location
+		}
+		allowed, undoThrottle := throttle.allow(throttleKey, time.Now())
+		if !allowed {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":      "throttled",
+				"message":     fmt.Sprintf("Reading skipped: less than %v since the last stored reading", throttle.interval),
+				"server_time": received.Format(serverTimeFormat),
+			})
+			return
+		}
+
+		target, err := shards.writeDB(db, utc)
+		if err != nil {
+			undoThrottle()
+			writeDBError(w, r, err)
+			return
+		}
+		args := []interface{}{data.Temperature, data.Humidity, data.Pressure, gasResistance, data.AQI, location, utc.Format(time.RFC3339),
+			data.WindSpeed, data.WindDirection, data.Rainfall, data.Warmup, nullableNote(data.Note), altitude}
+		if storeDerived {
+			args = append(args, derivedArgs(data.Temperature, data.Humidity, cfg.RoundDecimals)...)
+		}
+		if storeClockSkew {
+			var skew interface{}
+			if data.Timestamp != "" {
+				skew = roundTo(utc.Sub(received).Seconds(), 3)
+			}
+			args = append(args, skew)
+		}
+		err = writes.insert(target, args...)
+		if err != nil {
+			undoThrottle()
+		}
+		if errors.Is(err, errQueueFull) {
+			logf(r, "Write queue full, rejecting reading")
+			http.Error(w, "Server busy, please retry", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		aqiStr := "N/A"
+		if data.AQI != nil {
+			aqiStr = fmt.Sprintf("%d", *data.AQI)
+		}
+		logf(r, "Data recorded: Temp=%.2f°C, Hum=%.2f%%, Pres=%.2fhPa, Gas=%v, AQI=%s",
+			data.Temperature, data.Humidity, data.Pressure, gasResistance, aqiStr)
+
+		// Check alert thresholds
+		alertValues := map[string]float64{"temperature": data.Temperature}
+		if data.AQI != nil {
+			alertValues["aqi"] = float64(*data.AQI)
+		}
+		alertLocation := ""
+		if location != nil {
+			alertLocation = *location
+		}
+		alerter.check(alertLocation, alertValues, utc)
+
+		// Forward the stored reading, with its resolved time, location and altitude
+		mirrored := data
+		mirrored.Timestamp = utc.Format(time.RFC3339)
+		mirrored.Location = location
+		mirrored.Altitude = altitude
+		mirror.enqueue(mirrored)
+
+		// The new row is now the latest one
+		latest.invalidate()
+		rollup.touch(utc)
+
+		// Notify SSE subscribers
+		event := map[string]interface{}{
+			"temperature": data.Temperature,
+			"humidity":    data.Humidity,
+			"pressure":    data.Pressure,
+			"timestamp":   utc.Format(time.RFC3339),
+		}
+		if gasResistance != nil {
+			event["gas_resistance"] = *gasResistance
+		}
+		if data.AQI != nil {
+			event["aqi"] = *data.AQI
+		}
+		if location != nil {
+			event["location"] = *location
+		}
+		if payload, err := json.Marshal(event); err == nil {
+			broker.publish(payload)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":      "success",
+			"message":     "Data recorded successfully",
+			"server_time": received.Format(serverTimeFormat),
+		})
+	}))
+
+	// API: Backfill readings from an uploaded CSV in the export format
+	http.HandleFunc("/import/csv", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !canWrite(r, writeAPIKey) {
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		// Rows imported with a tenant key are stored under its location
+		var importLocation interface{}
+		ranges := cfg.Validation
+		if tenant, ok := tenantLocation(r.Context()); ok {
+			importLocation = tenant
+			ranges = cfg.rangesFor(tenant)
+		}
+
+		csvOpts, err := parseCSVOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dryRun := r.URL.Query().Get("dry_run") == "true"
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload exceeds %d bytes", maxErr.Limit))
+				return
+			}
+			http.Error(w, fmt.Sprintf("Expected a multipart upload with a \"file\" field: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		reader := csv.NewReader(file)
+		reader.Comma = csvOpts.Delimiter
+		reader.FieldsPerRecord = -1
+
+		// Validate every row first; nothing is written unless the file parses
+		type importRow struct {
+			data SensorData
+			utc  time.Time
+		}
+		var valid []importRow
+		rejected := []csvImportRejection{}
+		now := time.Now()
+		for line := 1; ; line++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				var parseErr *csv.ParseError
+				if errors.As(err, &parseErr) {
+					rejected = append(rejected, csvImportRejection{Line: line, Error: parseErr.Err.Error()})
+					continue
+				}
+				logf(r, "CSV import read error: %v", err)
+				http.Error(w, fmt.Sprintf("Failed to read upload: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			// Optional header row, as written by /tempget
+			if line == 1 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "Temperature") {
+				continue
+			}
+
+			data, err := parseCSVReading(record, csvOpts, localZone)
+			if err != nil {
+				rejected = append(rejected, csvImportRejection{Line: line, Error: err.Error()})
+				continue
+			}
+			if clamped := clamp.apply(&data, ranges); len(clamped) > 0 {
+				logf(r, "Clamped line %d: %s", line, strings.Join(clamped, ", "))
+			}
+			errs := data.validate(ranges)
+			utc, tsErrs := data.readingTime(now, maxFutureSkew)
+			errs = append(errs, tsErrs...)
+			if len(errs) > 0 {
+				msgs := make([]string, len(errs))
+				for i, e := range errs {
+					msgs[i] = e.Message
+				}
+				rejected = append(rejected, csvImportRejection{Line: line, Error: strings.Join(msgs, "; ")})
+				continue
+			}
+
+			data.Temperature = roundTo(data.Temperature, cfg.RoundDecimals)
+			data.Humidity = roundTo(data.Humidity, cfg.RoundDecimals)
+			data.Pressure = roundTo(data.Pressure, cfg.RoundDecimals)
+			if data.GasResistance != nil && *data.GasResistance <= 0 {
+				data.GasResistance = nil
+			}
+			valid = append(valid, importRow{data: data, utc: utc})
+		}
+
+		inserted := 0
+		if !dryRun && len(valid) > 0 {
+			// One transaction per destination; in shard mode that is per month
+			var targets []*sql.DB
+			groups := map[*sql.DB][]importRow{}
+			for _, row := range valid {
+				target, err := shards.writeDB(db, row.utc)
+				if err != nil {
+					writeDBError(w, r, err)
+					return
+				}
+				if _, ok := groups[target]; !ok {
+					targets = append(targets, target)
+				}
+				groups[target] = append(groups[target], row)
+			}
+
+			for _, target := range targets {
+				rows := groups[target]
+				err = writes.transaction(r.Context(), target, func(tx *sql.Tx) error {
+					stmt, err := tx.Prepare(insertReading)
+					if err != nil {
+						return err
+					}
+					defer stmt.Close()
+					for _, row := range rows {
+						d := row.data
+						args := []interface{}{d.Temperature, d.Humidity, d.Pressure, d.GasResistance, d.AQI, importLocation, row.utc.Format(time.RFC3339), nil, nil, nil, false, nil, cfg.StationAltitude}
+						if storeDerived {
+							args = append(args, derivedArgs(d.Temperature, d.Humidity, cfg.RoundDecimals)...)
+						}
+						if storeClockSkew {
+							args = append(args, nil) // Imported rows were not sent live
+						}
+						if _, err := stmt.Exec(args...); err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					break
+				}
+				inserted += len(rows)
+			}
+			if inserted > 0 {
+				latest.invalidate()
+				times := make([]time.Time, len(valid))
+				for i, row := range valid {
+					times[i] = row.utc
+				}
+				rollup.touch(times...)
+			}
+			if err != nil {
+				logf(r, "Database error after inserting %d rows: %v", inserted, err)
+				http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
+				return
+			}
+			logf(r, "CSV import inserted %d rows, skipped %d", inserted, len(rejected))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "success",
+			"dry_run":  dryRun,
+			"valid":    len(valid),
+			"inserted": inserted,
+			"skipped":  len(rejected),
+			"rejected": rejected,
+		})
+	})
+
+	// API: Get latest reading
+	http.HandleFunc("/temp", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fields, err := parseFields(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeFormat, err := parseTimeFormat(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Each metric's newest non-null value, possibly from different rows
+		if r.URL.Query().Get("latest_nonnull") == "true" {
+			results, err := queryLatestNonNull(r.Context(), db, shards, cfg.RoundDecimals, r.URL.Query().Get("exclude_warmup") == "true")
+			if err != nil {
+				if err == sql.ErrNoRows {
+					http.Error(w, "No data available", http.StatusNotFound)
+					return
+				}
+				writeDBError(w, r, err)
+				return
+			}
+			filterFields(results, fields)
+			for _, entry := range results {
+				if entry, ok := entry.(map[string]interface{}); ok {
+					formatTimestamp(entry, timeFormat)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(results)
+			return
+		}
+
+		// The validators and cache track the newest row, which may be a warmup
+		// reading, so filtered requests always query
+		if r.URL.Query().Get("exclude_warmup") == "true" {
+			results, err := queryLatest(r.Context(), db, shards, cfg.RoundDecimals, storeDerived, true, fields)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					http.Error(w, "No data available", http.StatusNotFound)
+					return
+				}
+				writeDBError(w, r, err)
+				return
+			}
+			filterFields(results, fields)
+			formatTimestamp(results, timeFormat)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(results)
+			return
+		}
+
+		// The cache holds every field of the newest reading of any location,
+		// so only tenant requests, which bypass it, select just the fields
+		_, scoped := tenantLocation(r.Context())
+		results, version, ok := latest.get()
+		if !ok || scoped {
+			selected := map[string]bool(nil)
+			if scoped {
+				selected = fields
+			}
+			var err error
+			results, err = queryLatest(r.Context(), db, shards, cfg.RoundDecimals, storeDerived, false, selected)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					http.Error(w, "No data available", http.StatusNotFound)
+					return
+				}
+				writeDBError(w, r, err)
+				return
+			}
+			if !scoped {
+				latest.set(results, version)
+			}
+		}
+
+		// Validators let polling clients and caches revalidate cheaply
+		etag, modified := latestValidators(results)
+		w.Header().Set("ETag", etag)
+		if !modified.IsZero() {
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		}
+		if notModified(r, etag, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		filterFields(results, fields)
+		formatTimestamp(results, timeFormat)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Get everything the dashboard landing page needs in one call
+	http.HandleFunc("/dashboard/summary", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		summary := map[string]interface{}{
+			"latest":         nil,
+			"pressure_trend": nil,
+		}
+
+		_, scoped := tenantLocation(r.Context())
+		reading, version, ok := latest.get()
+		if !ok || scoped {
+			var err error
+			reading, err = queryLatest(r.Context(), db, shards, cfg.RoundDecimals, storeDerived, false, nil)
+			if err != nil && err != sql.ErrNoRows {
+				writeDBError(w, r, err)
+				return
+			}
+			if reading != nil && !scoped {
+				latest.set(reading, version)
+			}
+		}
+		if reading != nil {
+			summary["latest"] = reading
+		}
+
+		// Today runs from local midnight to local midnight
+		localStart, localEnd := localDayBounds(time.Now(), 0, localZone)
+
+		today, err := queryStats(r.Context(), db, shards, rollup, localStart, localEnd, false, nil)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		roundMetrics(today, cfg.RoundDecimals)
+
+		conn, table, release, err := shards.readConn(r.Context(), db, localStart, localEnd)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+
+		var count int
+		err = conn.QueryRowContext(r.Context(), `SELECT COUNT(*) FROM `+table+` WHERE timestamp >= ? AND timestamp < ?`,
+			localStart.UTC().Format(time.RFC3339), localEnd.UTC().Format(time.RFC3339)).Scan(&count)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		today["count"] = count
+		today["date"] = localStart.Format("2006-01-02")
+		today["timezone"] = localZone.String()
+		summary["today"] = today
+
+		trend, err := pressureTrend(r.Context(), db, shards, pressureTrendWindow)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		if trend != nil {
+			summary["pressure_trend"] = trend["trend"]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	})
+
+	// API: Get current conditions averaged over the last few minutes
+	http.HandleFunc("/temp/current", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		window := 5 * time.Minute
+		if v := r.URL.Query().Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid window %q (expected a duration such as 10m)", v), http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+
+		fields, err := parseFields(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now().UTC()
+		conn, table, release, err := shards.readConn(r.Context(), db, now.Add(-window), now)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		excludeWarmup := r.URL.Query().Get("exclude_warmup") == "true"
+		if excludeWarmup {
+			table = withoutWarmup(table)
+		}
+
+		since := now.Add(-window).Format(time.RFC3339)
+		column := func(name string) string { return fieldColumn(name, fields) }
+		sqlStmt := `SELECT COUNT(*), AVG(` + column("temperature") + `), AVG(` + column("humidity") + `), AVG(` + column("pressure") + `),
+			AVG(` + column("aqi") + `), MIN(timestamp), MAX(timestamp)
+			FROM ` + table + ` WHERE timestamp >= ?`
+
+		var samples int
+		var temperature, humidity, pressure, aqi sql.NullFloat64
+		var from, to sql.NullString
+		err = conn.QueryRowContext(r.Context(), sqlStmt, since).Scan(&samples, &temperature, &humidity, &pressure, &aqi, &from, &to)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		// Nothing recent: fall back to the single latest reading
+		source := "average"
+		if samples == 0 {
+			source = "latest"
+			latestTable := scopeTable(r.Context(), "temp")
+			if excludeWarmup {
+				latestTable = withoutWarmup(latestTable)
+			}
+			sqlStmt = `SELECT ` + selectFields("temperature, humidity, pressure, aqi", fields) + `, timestamp, timestamp FROM ` + latestTable + ` ORDER BY id DESC LIMIT 1`
+			err = shards.newestFirst(db, func(db *sql.DB) error {
+				return db.QueryRowContext(r.Context(), sqlStmt).Scan(&temperature, &humidity, &pressure, &aqi, &from, &to)
+			})
+			if err == sql.ErrNoRows {
+				http.Error(w, "No data available", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+			samples = 1
+		}
+
+		results := map[string]interface{}{
+			"temperature": temperature.Float64,
+			"humidity":    humidity.Float64,
+			"pressure":    pressure.Float64,
+			"samples":     samples,
+			"window":      window.String(),
+			"source":      source,
+			"from":        from.String,
+			"to":          to.String,
+		}
+		if aqi.Valid {
+			results["aqi"] = aqi.Float64
+			results["aqi_category"] = aqiCategory(int(math.Round(aqi.Float64)))
+		}
+		roundMetrics(results, cfg.RoundDecimals)
+		filterFields(results, fields)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Comfort label and score for the latest reading
+	http.HandleFunc("/temp/comfort", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var rec DatabaseRecord
+		err := shards.newestFirst(db, func(db *sql.DB) error {
+			var err error
+			rec, err = scanReading(db.QueryRowContext(r.Context(), `SELECT `+recordColumns+` FROM `+scopeTable(r.Context(), "temp")+` ORDER BY id DESC LIMIT 1`))
+			return err
+		})
+		if err == sql.ErrNoRows {
+			http.Error(w, "No data available", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		hi := heatIndex(rec.Temperature, rec.Humidity)
+		score, label := comfortScore(map[string]float64{"heat_index": hi, "humidity": rec.Humidity})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"label":       label,
+			"score":       roundTo(score, cfg.RoundDecimals),
+			"heat_index":  roundTo(hi, cfg.RoundDecimals),
+			"temperature": rec.Temperature,
+			"humidity":    rec.Humidity,
+			"timestamp":   rec.Timestamp.Format(time.RFC3339),
+		})
+	})
+
+	// API: Delete or update a reading by ID
+	http.HandleFunc("/temp/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete && r.Method != http.MethodPatch {
+			http.Error(w, "Only DELETE and PATCH methods are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !canWrite(r, writeAPIKey) {
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id: must be numeric", http.StatusBadRequest)
+			return
+		}
+
+		// Find the database holding the reading; in shard mode the id names
+		// its shard. Readings of other tenants' locations are reported as
+		// missing.
+		target, err := shards.byID(db, id)
+		if err == nil {
+			var exists int
+			err = target.QueryRowContext(r.Context(), `SELECT 1 FROM `+scopeTable(r.Context(), "temp")+` WHERE id = ?`, id).Scan(&exists)
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("No reading with id %d", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			var deletedAt string
+			err := target.QueryRowContext(r.Context(), `DELETE FROM temp WHERE id = ? RETURNING timestamp`, id).Scan(&deletedAt)
+			if err == sql.ErrNoRows {
+				http.Error(w, fmt.Sprintf("No reading with id %d", id), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+
+			logf(r, "Deleted reading id=%d", id)
+			latest.invalidate()
+			if t, err := time.Parse(time.RFC3339, deletedAt); err == nil {
+				rollup.touch(t)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "deleted_id": id})
+			return
+		}
+
+		var patch ReadingPatch
+		if !decodeJSONBody(w, r, &patch, maxBodyBytes) {
+			return
+		}
+
+		// Validate against the bounds for the reading's location. Stored
+		// derived values need the unpatched temperature or humidity too.
+		ranges := cfg.Validation
+		recomputeDerived := storeDerived && (patch.Temperature != nil || patch.Humidity != nil)
+		var storedTemperature, storedHumidity float64
+		if len(cfg.locationRanges) > 0 || recomputeDerived {
+			var location sql.NullString
+			err := target.QueryRowContext(r.Context(), `SELECT location, temperature, humidity FROM temp WHERE id = ?`, id).
+				Scan(&location, &storedTemperature, &storedHumidity)
+			if err == sql.ErrNoRows {
+				http.Error(w, fmt.Sprintf("No reading with id %d", id), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+			if len(cfg.locationRanges) > 0 {
+				ranges = cfg.rangesFor(location.String)
+			}
+		}
+
+		// Validate only the fields present in the body, reporting every
+		// failure at once as /temprec does
+		if errs := patch.validate(ranges); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		var sets []string
+		var args []interface{}
+		if patch.Temperature != nil {
+			sets, args = append(sets, "temperature = ?"), append(args, roundTo(*patch.Temperature, cfg.RoundDecimals))
+		}
+		if patch.Humidity != nil {
+			sets, args = append(sets, "humidity = ?"), append(args, roundTo(*patch.Humidity, cfg.RoundDecimals))
+		}
+		if patch.Pressure != nil {
+			sets, args = append(sets, "pressure = ?"), append(args, roundTo(*patch.Pressure, cfg.RoundDecimals))
+		}
+		if patch.GasResistance != nil {
+			sets, args = append(sets, "gas_resistance = ?"), append(args, *patch.GasResistance)
+		}
+		if patch.AQI != nil {
+			sets, args = append(sets, "aqi = ?"), append(args, *patch.AQI)
+		}
+		if len(sets) == 0 {
+			http.Error(w, "No updatable fields provided", http.StatusBadRequest)
+			return
+		}
+		if recomputeDerived {
+			temperature, humidity := storedTemperature, storedHumidity
+			if patch.Temperature != nil {
+				temperature = *patch.Temperature
+			}
+			if patch.Humidity != nil {
+				humidity = *patch.Humidity
+			}
+			for _, column := range derivedColumns {
+				sets = append(sets, column+" = ?")
+			}
+			args = append(args, derivedArgs(temperature, humidity, cfg.RoundDecimals)...)
+		}
+
+		sqlStmt := `UPDATE temp SET ` + strings.Join(sets, ", ") + ` WHERE id = ?`
+		res, err := target.ExecContext(r.Context(), sqlStmt, append(args, id)...)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			http.Error(w, fmt.Sprintf("No reading with id %d", id), http.StatusNotFound)
+			return
+		}
+
+		logf(r, "Updated reading id=%d (%s)", id, strings.Join(sets, ", "))
+		latest.invalidate()
+
+		// Return the updated row
+		var location sql.NullString
+		var wr windRain
+		rec, err := scanReading(target.QueryRowContext(r.Context(), `SELECT `+recordColumns+`, location, `+windRainColumns+` FROM temp WHERE id = ?`, id),
+			&location, &wr.WindSpeed, &wr.WindDirection, &wr.Rainfall)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		rollup.touch(rec.Timestamp)
+
+		results := rec.result()
+		results["id"] = id
+		if rec.AQI != nil {
+			results["aqi_category"] = aqiCategory(*rec.AQI)
+		}
+		if location.Valid {
+			results["location"] = location.String
+		}
+		wr.addTo(results)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Get latest reading for each distinct location
+	http.HandleFunc("/temp/latest-per-location", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fields, err := parseFields(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Readings without a location form their own (null) group
+		sqlStmt := `
+			SELECT ` + selectFields(recordColumns+`, location, `+windRainColumns, fields) + `
+			FROM (
+				SELECT *, ROW_NUMBER() OVER (PARTITION BY location ORDER BY timestamp DESC, id DESC) AS rn
+				FROM ` + scopeTable(r.Context(), "temp") + `
+			)
+			WHERE rn = 1
+			ORDER BY location`
+
+		// Shards are visited newest first, so the first row seen for a
+		// location is its latest
+		results := []map[string]interface{}{}
+		seen := map[sql.NullString]bool{}
+		err = shards.each(db, false, func(db *sql.DB, _ time.Time) (bool, error) {
+			rows, err := db.QueryContext(r.Context(), sqlStmt)
+			if err != nil {
+				return false, err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var location sql.NullString
+				var wr windRain
+				rec, err := scanReading(rows, &location, &wr.WindSpeed, &wr.WindDirection, &wr.Rainfall)
+				if err != nil {
+					logf(r, "Row scan error: %v", err)
+					continue
+				}
+				if seen[location] {
+					continue
+				}
+				seen[location] = true
+
+				result := rec.result()
+				result["location"] = nil
+				if location.Valid {
+					result["location"] = location.String
+				}
+				if rec.AQI != nil {
+					result["aqi_category"] = aqiCategory(*rec.AQI)
+				}
+				wr.addTo(result)
+				filterFields(result, fields)
+
+				results = append(results, result)
+			}
+			return true, rows.Err()
+		})
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		// Readings without a location sort first, as in SQLite
+		slices.SortFunc(results, func(a, b map[string]interface{}) int {
+			if (a["location"] == nil) != (b["location"] == nil) {
+				if a["location"] == nil {
+					return -1
+				}
+				return 1
+			}
+			la, _ := a["location"].(string)
+			lb, _ := b["location"].(string)
+			return strings.Compare(la, lb)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: List known sensor locations, most recently seen first
+	http.HandleFunc("/locations", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		sqlStmt := `
+			SELECT location, COUNT(*), MAX(timestamp)
+			FROM ` + scopeTable(r.Context(), "temp") + `
+			WHERE location IS NOT NULL
+			GROUP BY location`
+
+		// Counts add up across shards and the newest shard has the latest time
+		type locationInfo struct {
+			count  int
+			latest string
+		}
+		infos := map[string]*locationInfo{}
+		err := shards.each(db, false, func(db *sql.DB, _ time.Time) (bool, error) {
+			rows, err := db.QueryContext(r.Context(), sqlStmt)
+			if err != nil {
+				return false, err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var location, latest string
+				var count int
+				if err := rows.Scan(&location, &count, &latest); err != nil {
+					logf(r, "Row scan error: %v", err)
+					continue
+				}
+				if info, ok := infos[location]; ok {
+					info.count += count
+					continue
+				}
+				infos[location] = &locationInfo{count: count, latest: latest}
+			}
+			return true, rows.Err()
+		})
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		results := []map[string]interface{}{}
+		for _, location := range slices.Sorted(maps.Keys(infos)) {
+			results = append(results, map[string]interface{}{
+				"location": location,
+				"count":    infos[location].count,
+				"latest":   infos[location].latest,
+			})
+		}
+		slices.SortStableFunc(results, func(a, b map[string]interface{}) int {
+			return strings.Compare(b["latest"].(string), a["latest"].(string))
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Get the readings immediately before and after a point in time
+	http.HandleFunc("/temp/around", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		at, err := time.Parse(time.RFC3339, q.Get("timestamp"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid timestamp %q (expected RFC3339, e.g. 2024-01-15T12:00:00Z)", q.Get("timestamp")), http.StatusBadRequest)
+			return
+		}
+		counts := map[string]int{"before": 10, "after": 10}
+		for name := range counts {
+			if v := q.Get(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 || n > 500 {
+					http.Error(w, fmt.Sprintf("%s must be an integer between 0 and 500", name), http.StatusBadRequest)
+					return
+				}
+				counts[name] = n
+			}
+		}
+		fields, err := parseFields(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ts := at.UTC().Format(time.RFC3339)
+		table := scopeTable(r.Context(), "temp")
+		columns := selectFields(recordColumns+`, id, location, `+windRainColumns+`, note, altitude`, fields)
+
+		// aroundRow is one reading as returned, with its parsed time
+		type aroundRow struct {
+			result    map[string]interface{}
+			timestamp time.Time
+		}
+		scanRows := func(rows *sql.Rows, into *[]aroundRow) error {
+			defer rows.Close()
+			for rows.Next() {
+				var id int
+				var location sql.NullString
+				var wr windRain
+				var note sql.NullString
+				var altitude sql.NullFloat64
+				rec, err := scanReading(rows, &id, &location, &wr.WindSpeed, &wr.WindDirection, &wr.Rainfall, &note, &altitude)
+				if err != nil {
+					logf(r, "Row scan error: %v", err)
+					continue
+				}
+
+				result := rec.result()
+				result["id"] = id
+				result["location"] = nil
+				result["closest"] = false
+				if location.Valid {
+					result["location"] = location.String
+				}
+				wr.addTo(result)
+				if note.Valid && note.String != "" {
+					result["note"] = note.String
+				}
+				addSeaLevelPressure(result, rec.Temperature, rec.Pressure, altitude, cfg.RoundDecimals)
+				filterFields(result, fields)
+				*into = append(*into, aroundRow{result: result, timestamp: rec.Timestamp})
+			}
+			return rows.Err()
+		}
+
+		// Walk the shards away from the timestamp in each direction until
+		// enough rows are found, skipping months entirely on the other side
+		var before, after []aroundRow
+		err = shards.each(db, false, func(db *sql.DB, month time.Time) (bool, error) {
+			if len(before) >= counts["before"] {
+				return false, nil
+			}
+			if !month.IsZero() && !month.Before(at) {
+				return true, nil
+			}
+			rows, err := db.QueryContext(r.Context(), `SELECT `+columns+` FROM `+table+`
+				WHERE timestamp < ? ORDER BY timestamp DESC, id DESC LIMIT ?`, ts, counts["before"]-len(before))
+			if err != nil {
+				return false, err
+			}
+			return true, scanRows(rows, &before)
+		})
+		if err == nil {
+			err = shards.each(db, true, func(db *sql.DB, month time.Time) (bool, error) {
+				if len(after) >= counts["after"] {
+					return false, nil
+				}
+				if !month.IsZero() && !at.Before(month.AddDate(0, 1, 0)) {
+					return true, nil
+				}
+				rows, err := db.QueryContext(r.Context(), `SELECT `+columns+` FROM `+table+`
+					WHERE timestamp >= ? ORDER BY timestamp ASC, id ASC LIMIT ?`, ts, counts["after"]-len(after))
+				if err != nil {
+					return false, err
+				}
+				return true, scanRows(rows, &after)
+			})
+		}
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		slices.Reverse(before)
+
+		results := []map[string]interface{}{}
+		closest, closestDiff := -1, time.Duration(0)
+		for _, row := range append(before, after...) {
+			// Earlier rows win ties, so the first of equally close rows is marked
+			diff := row.timestamp.Sub(at).Abs()
+			if closest < 0 || diff < closestDiff {
+				closest, closestDiff = len(results), diff
+			}
+			results = append(results, row.result)
+		}
+
+		if closest >= 0 {
+			results[closest]["closest"] = true
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Get readings from the last duration, e.g. /temp/last?duration=6h
+	http.HandleFunc("/temp/last", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		duration, err := time.ParseDuration(q.Get("duration"))
+		if err != nil || duration <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid duration %q (expected a duration such as 6h)", q.Get("duration")), http.StatusBadRequest)
+			return
+		}
+		if maxRangeDays > 0 && duration > time.Duration(maxRangeDays)*24*time.Hour {
+			http.Error(w, fmt.Sprintf("duration exceeds the maximum of %d days", maxRangeDays), http.StatusBadRequest)
+			return
+		}
+
+		var interval time.Duration
+		if v := q.Get("interval"); v != "" {
+			interval, err = time.ParseDuration(v)
+			if err != nil || interval < time.Second {
+				http.Error(w, fmt.Sprintf("Invalid interval %q (expected a duration of at least 1s such as 10m)", v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := 0
+		if v := q.Get("limit"); v != "" {
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > 10000 {
+				http.Error(w, "limit must be an integer between 1 and 10000", http.StatusBadRequest)
+				return
+			}
+		}
+
+		fields, err := parseFields(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeFormat, err := parseTimeFormat(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		end := time.Now().UTC()
+		start := end.Add(-duration)
+
+		conn, table, release, err := shards.readConn(r.Context(), db, start, end)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		if q.Get("exclude_warmup") == "true" {
+			table = withoutWarmup(table)
+		}
+
+		// Newest rows first so that limit keeps the most recent ones; the
+		// result is put back in ascending order below
+		var sqlStmt string
+		args := []interface{}{start.Format(time.RFC3339), end.Format(time.RFC3339)}
+		if interval > 0 && interval%time.Hour == 0 {
+			// Whole-hour buckets start on UTC hour boundaries, so the hours
+			// rolled up in hourly_summary can stand in for their readings
+			var summarized bool
+			var from, to time.Time
+			if q.Get("exclude_warmup") != "true" {
+				from, to, summarized, err = rollup.span(r.Context(), conn, start, end)
+				if err != nil {
+					writeDBError(w, r, err)
+					return
+				}
+			}
+			if !summarized {
+				from, to = start, start
+			}
+			partials, partialArgs := hourlyPartials(r.Context(), table, start, end, from, to, true)
+			average := func(metric, count string) string {
+				if fieldColumn(metric, fields) != metric {
+					return fieldColumn(metric, fields)
+				}
+				return `SUM(avg_` + metric + ` * ` + count + `) / SUM(` + count + `)`
+			}
+			sqlStmt = `
+				SELECT ` + average("temperature", "count") + `, ` + average("humidity", "count") + `,
+					` + average("pressure", "count") + `,
+					` + average("gas_resistance", "gas_resistance_count") + `,
+					` + average("aqi", "aqi_count") + `, MIN(first_timestamp), SUM(count)
+				FROM ` + partials + `
+				GROUP BY (CAST(strftime('%s', hour) AS INTEGER) - ?) / ?
+				ORDER BY MIN(first_timestamp) DESC`
+			args = append(partialArgs, start.Truncate(time.Hour).Unix(), int64(interval/time.Second))
+		} else if interval > 0 {
+			column := func(name string) string { return fieldColumn(name, fields) }
+			sqlStmt = `
+				SELECT AVG(` + column("temperature") + `), AVG(` + column("humidity") + `), AVG(` + column("pressure") + `),
+					AVG(` + column("gas_resistance") + `), AVG(` + column("aqi") + `), MIN(timestamp), COUNT(*)
+				FROM ` + table + `
+				WHERE timestamp >= ? AND timestamp <= ?
+				GROUP BY (CAST(strftime('%s', timestamp) AS INTEGER) - ?) / ?
+				ORDER BY MIN(timestamp) DESC`
+			args = append(args, start.Unix(), int64(interval/time.Second))
+		} else {
+			sqlStmt = `
+				SELECT ` + selectFields(recordColumns, fields) + `
+				FROM ` + table + `
+				WHERE timestamp >= ? AND timestamp <= ?
+				ORDER BY timestamp DESC`
+		}
+		if limit > 0 {
+			sqlStmt += ` LIMIT ?`
+			args = append(args, limit)
+		}
+
+		rows, err := conn.QueryContext(r.Context(), sqlStmt, args...)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		// Raw readings go through scanReading; buckets hold averages, so
+		// their gas resistance and AQI stay fractional
+		scanBucket := func(rows *sql.Rows) (map[string]interface{}, error) {
+			var temperature, humidity, pressure float64
+			var gasResistance, aqi sql.NullFloat64
+			var timestampStr string
+			var samples int
+			if err := rows.Scan(&temperature, &humidity, &pressure, &gasResistance, &aqi, &timestampStr, &samples); err != nil {
+				return nil, err
+			}
+			result := map[string]interface{}{
+				"temperature": temperature,
+				"humidity":    humidity,
+				"pressure":    pressure,
+				"timestamp":   timestampStr,
+				"samples":     samples,
+			}
+			if gasResistance.Valid {
+				result["gas_resistance"] = gasResistance.Float64
+			}
+			if aqi.Valid {
+				result["aqi"] = aqi.Float64
+			}
+			return result, nil
+		}
+
+		results := []map[string]interface{}{}
+		for rows.Next() {
+			var result map[string]interface{}
+			if interval > 0 {
+				result, err = scanBucket(rows)
+			} else {
+				var rec DatabaseRecord
+				rec, err = scanReading(rows)
+				result = rec.result()
+			}
+			if err != nil {
+				logf(r, "Row scan error: %v", err)
+				continue
+			}
+			roundMetrics(result, cfg.RoundDecimals)
+			filterFields(result, fields)
+			formatTimestamp(result, timeFormat)
+			results = append(results, result)
+		}
+
+		if err = rows.Err(); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		slices.Reverse(results)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Get downsampled parallel arrays for sparklines
+	http.HandleFunc("/temp/sparkline", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		hours := 24
+		if v := r.URL.Query().Get("hours"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 24*366 {
+				http.Error(w, "hours must be an integer between 1 and 8784", http.StatusBadRequest)
+				return
+			}
+			hours = n
+		}
+		points := 100
+		if v := r.URL.Query().Get("points"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 2 || n > 1000 {
+				http.Error(w, "points must be an integer between 2 and 1000", http.StatusBadRequest)
+				return
+			}
+			points = n
+		}
+
+		fields, err := parseFields(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Split the window into equal time buckets and average each one
+		end := time.Now().UTC()
+		start := end.Add(-time.Duration(hours) * time.Hour)
+		bucketSecs := int64(hours) * 3600 / int64(points)
+		if bucketSecs < 1 {
+			bucketSecs = 1
+		}
+
+		conn, table, release, err := shards.readConn(r.Context(), db, start, end)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		if r.URL.Query().Get("exclude_warmup") == "true" {
+			table = withoutWarmup(table)
+		}
+
+		column := func(name string) string { return fieldColumn(name, fields) }
+		sqlStmt := `
+			SELECT MIN(timestamp), AVG(` + column("temperature") + `), AVG(` + column("humidity") + `), AVG(` + column("pressure") + `),
+				AVG(` + column("gas_resistance") + `), AVG(` + column("aqi") + `)
+			FROM ` + table + `
+			WHERE timestamp >= ? AND timestamp <= ?
+			GROUP BY (CAST(strftime('%s', timestamp) AS INTEGER) - ?) / ?
+			ORDER BY MIN(timestamp) ASC`
+
+		rows, err := conn.QueryContext(r.Context(), sqlStmt, start.Format(time.RFC3339), end.Format(time.RFC3339), start.Unix(), bucketSecs)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		timestamps := []string{}
+		temperature := []float64{}
+		humidity := []float64{}
+		pressure := []float64{}
+		gasResistance := []interface{}{}
+		aqi := []interface{}{}
+		for rows.Next() {
+			var ts string
+			var temp, hum, pres float64
+			var gas, aq sql.NullFloat64
+			if err := rows.Scan(&ts, &temp, &hum, &pres, &gas, &aq); err != nil {
+				logf(r, "Row scan error: %v", err)
+				continue
+			}
+
+			timestamps = append(timestamps, ts)
+			temperature = append(temperature, temp)
+			humidity = append(humidity, hum)
+			pressure = append(pressure, pres)
+			if gas.Valid {
+				gasResistance = append(gasResistance, gas.Float64)
+			} else {
+				gasResistance = append(gasResistance, nil)
+			}
+			if aq.Valid {
+				aqi = append(aqi, aq.Float64)
+			} else {
+				aqi = append(aqi, nil)
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		results := map[string]interface{}{
+			"timestamps":     timestamps,
+			"temperature":    temperature,
+			"humidity":       humidity,
+			"pressure":       pressure,
+			"gas_resistance": gasResistance,
+			"aqi":            aqi,
+		}
+		roundMetrics(results, cfg.RoundDecimals)
+		filterFields(results, fields)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Get all-time (or range-scoped) record highs and lows for each metric
+	http.HandleFunc("/temp/extremes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		var where []string
+		var args []interface{}
+		if q.Has("startDate") || q.Has("endDate") {
+			startDate, endDate, errs := parseDateRange(DateRangeQuery{StartDate: q.Get("startDate"), EndDate: q.Get("endDate")})
+			if len(errs) > 0 {
+				writeValidationErrors(w, errs)
+				return
+			}
+			where = append(where, "timestamp >= ? AND timestamp <= ?")
+			args = append(args, startDate.Format(time.RFC3339), endDate.Format(time.RFC3339))
+		}
+		if location := q.Get("location"); location != "" {
+			where = append(where, "location = ?")
+			args = append(args, location)
+		}
+
+		results := map[string]interface{}{}
+		for _, metric := range []string{"temperature", "humidity", "pressure", "gas_resistance", "aqi", "wind_speed", "rainfall"} {
+			record := map[string]interface{}{"max": nil, "min": nil}
+			for key, order := range map[string]string{"max": "DESC", "min": "ASC"} {
+				// metric comes from the fixed list above; ties go to the earliest reading
+				sqlStmt := `SELECT ` + metric + `, timestamp FROM ` + scopeTable(r.Context(), "temp") + ` WHERE ` +
+					strings.Join(append([]string{metric + " IS NOT NULL"}, where...), " AND ") +
+					` ORDER BY ` + metric + ` ` + order + `, timestamp ASC LIMIT 1`
+				// Each shard has its own record; the best of them wins, with
+				// the same earliest-first tie break across shards
+				found := false
+				var best float64
+				var bestTimestamp string
+				err := shards.each(db, true, func(db *sql.DB, _ time.Time) (bool, error) {
+					var value float64
+					var timestampStr string
+					err := db.QueryRowContext(r.Context(), sqlStmt, args...).Scan(&value, &timestampStr)
+					if err == sql.ErrNoRows {
+						return true, nil
+					}
+					if err != nil {
+						return false, err
+					}
+					better := value > best
+					if key == "min" {
+						better = value < best
+					}
+					if !found || better || (value == best && timestampStr < bestTimestamp) {
+						found, best, bestTimestamp = true, value, timestampStr
+					}
+					return true, nil
+				})
+				if err != nil {
+					writeDBError(w, r, err)
+					return
+				}
+				if !found {
+					continue
+				}
+				record[key] = map[string]interface{}{
+					"value":     roundTo(best, cfg.RoundDecimals),
+					"timestamp": bestTimestamp,
+				}
+			}
+			results[metric] = record
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: List the annotated readings in a date range, oldest first
+	http.HandleFunc("/temp/notes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		startDate, endDate, errs := parseDateRange(DateRangeQuery{StartDate: q.Get("startDate"), EndDate: q.Get("endDate")})
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		conn, table, release, err := shards.readConn(r.Context(), db, startDate, endDate)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+
+		rows, err := conn.QueryContext(r.Context(), `
+			SELECT `+recordColumns+`, id, location, note
+			FROM `+table+`
+			WHERE timestamp >= ? AND timestamp <= ? AND note IS NOT NULL AND note != ''
+			ORDER BY timestamp ASC, id ASC`,
+			startDate.Format(time.RFC3339), endDate.Format(time.RFC3339))
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		results := []map[string]interface{}{}
+		for rows.Next() {
+			var id int
+			var location sql.NullString
+			var note string
+			rec, err := scanReading(rows, &id, &location, &note)
+			if err != nil {
+				logf(r, "Row scan error: %v", err)
+				continue
+			}
+
+			result := rec.result()
+			result["id"] = id
+			result["location"] = nil
+			result["note"] = note
+			if location.Valid {
+				result["location"] = location.String
+			}
+			results = append(results, result)
+		}
+		if err := rows.Err(); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Get the distribution of a metric over a date range
+	http.HandleFunc("/temp/histogram", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var query HistogramQuery
+		if !decodeJSONBody(w, r, &query, maxBodyBytes) {
+			return
+		}
+
+		startDate, endDate, errs := parseDateRange(query.DateRangeQuery)
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		column, ok := metricColumns[query.Metric]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Invalid metric %q (expected temperature, humidity, pressure, gas or aqi)", query.Metric), http.StatusBadRequest)
+			return
+		}
+		if query.Buckets == 0 {
+			query.Buckets = 10
+		}
+		if query.Buckets < 1 || query.Buckets > 1000 {
+			http.Error(w, "buckets must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		if query.Min != nil && query.Max != nil && *query.Max <= *query.Min {
+			http.Error(w, "max must be greater than min", http.StatusBadRequest)
+			return
+		}
+
+		conn, table, release, err := shards.readConn(r.Context(), db, startDate, endDate)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		if r.URL.Query().Get("exclude_warmup") == "true" {
+			table = withoutWarmup(table)
+		}
+
+		// column comes from the metricColumns whitelist
+		sqlStmt := `SELECT ` + column + ` FROM ` + table + ` WHERE timestamp >= ? AND timestamp <= ? AND ` + column + ` IS NOT NULL`
+		rows, err := conn.QueryContext(r.Context(), sqlStmt, startDate.Format(time.RFC3339), endDate.Format(time.RFC3339))
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		var values []float64
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for rows.Next() {
+			var v float64
+			if err := rows.Scan(&v); err != nil {
+				logf(r, "Row scan error: %v", err)
+				continue
+			}
+			values = append(values, v)
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+		if err = rows.Err(); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		results := map[string]interface{}{
+			"metric":  query.Metric,
+			"count":   len(values),
+			"buckets": []map[string]interface{}{},
+		}
+
+		if query.Min != nil {
+			lo = *query.Min
+		}
+		if query.Max != nil {
+			hi = *query.Max
+		}
+
+		// Without data and explicit bounds there is nothing to bucket
+		if !math.IsInf(lo, 0) && !math.IsInf(hi, 0) && hi >= lo {
+			if hi == lo {
+				hi = lo + 1
+			}
+			buckets, below, above := histogram(values, query.Buckets, lo, hi)
+			results["buckets"] = buckets
+			results["min"] = lo
+			results["max"] = hi
+			results["bucket_width"] = (hi - lo) / float64(query.Buckets)
+			results["below_min"] = below
+			results["above_max"] = above
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Correlate two metrics over a date range
+	http.HandleFunc("/temp/correlation", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var query CorrelationQuery
+		if !decodeJSONBody(w, r, &query, maxBodyBytes) {
+			return
+		}
+
+		startDate, endDate, errs := parseDateRange(query.DateRangeQuery)
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		columnX, okX := metricColumns[query.MetricX]
+		columnY, okY := metricColumns[query.MetricY]
+		if !okX || !okY {
+			bad := query.MetricX
+			if okX {
+				bad = query.MetricY
+			}
+			http.Error(w, fmt.Sprintf("Invalid metric %q (expected temperature, humidity, pressure, gas or aqi)", bad), http.StatusBadRequest)
+			return
+		}
+
+		conn, table, release, err := shards.readConn(r.Context(), db, startDate, endDate)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		if r.URL.Query().Get("exclude_warmup") == "true" {
+			table = withoutWarmup(table)
+		}
+
+		// Both columns come from the metricColumns whitelist
+		sqlStmt := `SELECT ` + columnX + `, ` + columnY + ` FROM ` + table + ` WHERE timestamp >= ? AND timestamp <= ? AND ` + columnX + ` IS NOT NULL AND ` + columnY + ` IS NOT NULL`
+		rows, err := conn.QueryContext(r.Context(), sqlStmt, startDate.Format(time.RFC3339), endDate.Format(time.RFC3339))
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		var xs, ys []float64
+		for rows.Next() {
+			var x, y float64
+			if err := rows.Scan(&x, &y); err != nil {
+				logf(r, "Row scan error: %v", err)
+				continue
+			}
+			xs = append(xs, x)
+			ys = append(ys, y)
+		}
+		if err = rows.Err(); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		if len(xs) < 2 {
+			http.Error(w, fmt.Sprintf("Not enough paired readings in the range to correlate (need at least 2, found %d)", len(xs)), http.StatusUnprocessableEntity)
+			return
+		}
+		coefficient, ok := pearson(xs, ys)
+		if !ok {
+			http.Error(w, "Correlation is undefined: one of the metrics is constant over the range", http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metric_x":    query.MetricX,
+			"metric_y":    query.MetricY,
+			"count":       len(xs),
+			"correlation": coefficient,
+		})
+	})
+
+	// API: Count readings per local hour, local day or location over a date range
+	http.HandleFunc("/temp/counts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var query CountsQuery
+		if !decodeJSONBody(w, r, &query, maxBodyBytes) {
+			return
+		}
+
+		startDate, endDate, errs := parseDateRange(query.DateRangeQuery)
+		layout, timeGrouping := countBucketFormats[query.GroupBy]
+		if !timeGrouping && query.GroupBy != "location" {
+			errs = append(errs, ValidationError{"group_by", fmt.Sprintf("invalid group_by %q (expected hour, day or location)", query.GroupBy)})
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		conn, table, release, err := shards.readConn(r.Context(), db, startDate, endDate)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+
+		// Both ends are inclusive, as in /tempdaterange; timestamps have second precision
+		end := endDate.Add(time.Second)
+		buckets := []map[string]interface{}{}
+		total := 0
+
+		if !timeGrouping {
+			rows, err := conn.QueryContext(r.Context(), `SELECT location, COUNT(*) FROM `+table+`
+				WHERE timestamp >= ? AND timestamp < ? GROUP BY location ORDER BY location`,
+				startDate.Format(time.RFC3339), end.Format(time.RFC3339))
+			if err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var location sql.NullString
+				var count int
+				if err := rows.Scan(&location, &count); err != nil {
+					logf(r, "Row scan error: %v", err)
+					continue
+				}
+				bucket := map[string]interface{}{"location": nil, "count": count}
+				if location.Valid {
+					bucket["location"] = location.String
+				}
+				buckets = append(buckets, bucket)
+				total += count
+			}
+			if err := rows.Err(); err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+		} else {
+			// strftime works in UTC, so each stretch with a fixed offset is shifted
+			// separately; an hour repeated by a DST fall-back shares one bucket
+			counts := map[string]int{}
+			for _, span := range offsetSpans(startDate, end, localZone) {
+				rows, err := conn.QueryContext(r.Context(), `SELECT strftime(?, timestamp, ?) AS bucket, COUNT(*) FROM `+table+`
+					WHERE timestamp >= ? AND timestamp < ? GROUP BY bucket`,
+					layout, fmt.Sprintf("%+d seconds", span.offset),
+					span.start.Format(time.RFC3339), span.end.Format(time.RFC3339))
+				if err != nil {
+					writeDBError(w, r, err)
+					return
+				}
+				for rows.Next() {
+					var bucket string
+					var count int
+					if err := rows.Scan(&bucket, &count); err != nil {
+						logf(r, "Row scan error: %v", err)
+						continue
+					}
+					counts[bucket] += count
+				}
+				err = rows.Err()
+				rows.Close()
+				if err != nil {
+					writeDBError(w, r, err)
+					return
+				}
+			}
+			for _, bucket := range slices.Sorted(maps.Keys(counts)) {
+				buckets = append(buckets, map[string]interface{}{"bucket": bucket, "count": counts[bucket]})
+				total += counts[bucket]
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"group_by": query.GroupBy,
+			"timezone": localZone.String(),
+			"total":    total,
+			"buckets":  buckets,
+		})
+	})
+
+	// API: Find intervals where the sensor stopped reporting
+	http.HandleFunc("/temp/gaps", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var query GapQuery
+		if !decodeJSONBody(w, r, &query, maxBodyBytes) {
+			return
+		}
+
+		startDate, endDate, errs := parseDateRange(query.DateRangeQuery)
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		interval, err := time.ParseDuration(query.ExpectedInterval)
+		if err != nil || interval <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid expected_interval %q (expected a duration such as 1m)", query.ExpectedInterval), http.StatusBadRequest)
+			return
+		}
+		if query.Factor == 0 {
+			query.Factor = 1.5
+		}
+		if query.Factor < 1 {
+			http.Error(w, "factor must be at least 1", http.StatusBadRequest)
+			return
+		}
+		threshold := time.Duration(float64(interval) * query.Factor)
+
+		conn, table, release, err := shards.readConn(r.Context(), db, startDate, endDate)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+
+		sqlStmt := `
+			SELECT prev, timestamp FROM (
+				SELECT timestamp, LAG(timestamp) OVER (ORDER BY timestamp) AS prev
+				FROM ` + table + `
+				WHERE timestamp >= ? AND timestamp <= ?
+			)
+			WHERE prev IS NOT NULL
+				AND CAST(strftime('%s', timestamp) AS INTEGER) - CAST(strftime('%s', prev) AS INTEGER) > ?
+			ORDER BY timestamp ASC`
+
+		rows, err := conn.QueryContext(r.Context(), sqlStmt, startDate.Format(time.RFC3339), endDate.Format(time.RFC3339), threshold.Seconds())
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		gaps := []map[string]interface{}{}
+		var total time.Duration
+		for rows.Next() {
+			var prevStr, nextStr string
+			if err := rows.Scan(&prevStr, &nextStr); err != nil {
+				logf(r, "Row scan error: %v", err)
+				continue
+			}
+			prev, err1 := time.Parse(time.RFC3339, prevStr)
+			next, err2 := time.Parse(time.RFC3339, nextStr)
+			if err1 != nil || err2 != nil {
+				logf(r, "Timestamp parse error: %v %v", err1, err2)
+				continue
+			}
+
+			gap := next.Sub(prev)
+			total += gap
+			gaps = append(gaps, map[string]interface{}{
+				"last_before":      prev.Format(time.RFC3339),
+				"first_after":      next.Format(time.RFC3339),
+				"duration":         gap.String(),
+				"duration_seconds": gap.Seconds(),
+			})
+		}
+
+		if err = rows.Err(); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"expected_interval": interval.String(),
+			"threshold":         threshold.String(),
+			"count":             len(gaps),
+			"total_gap_seconds": total.Seconds(),
+			"gaps":              gaps,
+		})
+	})
+
+	// API: Get daily statistics (local timezone)
+	http.HandleFunc("/tempstat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		percentiles, err := parsePercentiles(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		interval, err := parseExpectedInterval(r.URL.Query(), expectedInterval)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var dateQuery DateQuery
+		if !decodeJSONBody(w, r, &dateQuery, maxBodyBytes) {
+			return
+		}
+
+		// Validate date
+		if errs := dateQuery.validate(); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		// Create start and end of day in the local timezone
+		localStart := startOfLocalDay(dateQuery.Year, time.Month(dateQuery.Month), dateQuery.Day, localZone)
+		localEnd := startOfLocalDay(dateQuery.Year, time.Month(dateQuery.Month), dateQuery.Day+1, localZone)
+
+		// Convert to UTC for database query
+		utcStart := localStart.UTC()
+		utcEnd := localEnd.UTC()
+
+		excludeWarmup := r.URL.Query().Get("exclude_warmup") == "true"
+		results, err := queryStats(r.Context(), db, shards, rollup, utcStart, utcEnd, excludeWarmup, percentiles)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		roundMetrics(results, cfg.RoundDecimals)
+
+		// Strongly-typed clients may want every key, null when there is no data
+		if r.URL.Query().Get("include_nulls") == "true" {
+			includeNullStats(results, percentiles)
+		}
+
+		// Lets clients flag a day that is still in progress or has gaps
+		coverage, err := queryCoverage(r.Context(), db, shards, utcStart, utcEnd, time.Now(), interval, excludeWarmup)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		maps.Copy(results, coverage)
+
+		// Expose the resolved window so timezone conversion can be checked
+		if r.URL.Query().Get("debug") == "true" {
+			results["utc_start"] = utcStart.Format(time.RFC3339)
+			results["utc_end"] = utcEnd.Format(time.RFC3339)
+			results["timezone"] = localZone.String()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// localDayStats serves /tempstat for the local day daysAgo days before
+	// today, so clients don't have to work out the date in the server's zone
+	localDayStats := func(daysAgo int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			percentiles, err := parsePercentiles(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			interval, err := parseExpectedInterval(r.URL.Query(), expectedInterval)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			now := time.Now()
+			localStart, localEnd := localDayBounds(now, daysAgo, localZone)
+
+			excludeWarmup := r.URL.Query().Get("exclude_warmup") == "true"
+			results, err := queryStats(r.Context(), db, shards, rollup, localStart, localEnd, excludeWarmup, percentiles)
+			if err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+			roundMetrics(results, cfg.RoundDecimals)
+			if r.URL.Query().Get("include_nulls") == "true" {
+				includeNullStats(results, percentiles)
+			}
+
+			coverage, err := queryCoverage(r.Context(), db, shards, localStart, localEnd, now, interval, excludeWarmup)
+			if err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+			maps.Copy(results, coverage)
+
+			if r.URL.Query().Get("debug") == "true" {
+				results["utc_start"] = localStart.UTC().Format(time.RFC3339)
+				results["utc_end"] = localEnd.UTC().Format(time.RFC3339)
+				results["timezone"] = localZone.String()
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(results)
+		}
+	}
+
+	// API: Get statistics for today and yesterday in the configured timezone
+	http.HandleFunc("/tempstat/today", localDayStats(0))
+	http.HandleFunc("/tempstat/yesterday", localDayStats(1))
+
+	// API: Get monthly statistics bounded by local midnights
+	http.HandleFunc("/tempstat/localmonth", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		percentiles, err := parsePercentiles(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var monthQuery struct {
+			Month int `json:"month"`
+			Year  int `json:"year"`
+		}
+		if !decodeJSONBody(w, r, &monthQuery, maxBodyBytes) {
+			return
+		}
+
+		if monthQuery.Month < 1 || monthQuery.Month > 12 || monthQuery.Year < 2000 {
+			http.Error(w, "Invalid month", http.StatusBadRequest)
+			return
+		}
+
+		// The month runs from local midnight on the 1st to local midnight on
+		// the 1st of the next month, so it may be 1h shorter or longer in UTC
+		localStart := startOfLocalDay(monthQuery.Year, time.Month(monthQuery.Month), 1, localZone)
+		localEnd := startOfLocalDay(monthQuery.Year, time.Month(monthQuery.Month)+1, 1, localZone)
+
+		results, err := queryStats(r.Context(), db, shards, rollup, localStart, localEnd, r.URL.Query().Get("exclude_warmup") == "true", percentiles)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		roundMetrics(results, cfg.RoundDecimals)
+
+		results["timezone"] = localZone.String()
+		results["start"] = localStart.UTC().Format(time.RFC3339)
+		results["end"] = localEnd.UTC().Format(time.RFC3339)
+		results["hours"] = localEnd.Sub(localStart).Hours()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Time-weighted average AQI exposure over a local day
+	http.HandleFunc("/tempstat/exposure", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		maxGap := exposureMaxGap
+		if v := r.URL.Query().Get("max_gap"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid max_gap %q (expected a duration such as 1h)", v), http.StatusBadRequest)
+				return
+			}
+			maxGap = d
+		}
+
+		var dateQuery DateQuery
+		if !decodeJSONBody(w, r, &dateQuery, maxBodyBytes) {
+			return
+		}
+		if errs := dateQuery.validate(); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		localStart := startOfLocalDay(dateQuery.Year, time.Month(dateQuery.Month), dateQuery.Day, localZone)
+		localEnd := startOfLocalDay(dateQuery.Year, time.Month(dateQuery.Month), dateQuery.Day+1, localZone)
+		utcStart, utcEnd := localStart.UTC(), localEnd.UTC()
+
+		conn, table, release, err := shards.readConn(r.Context(), db, utcStart, utcEnd)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		if r.URL.Query().Get("exclude_warmup") == "true" {
+			table = withoutWarmup(table)
+		}
+
+		rows, err := conn.QueryContext(r.Context(), `SELECT aqi, timestamp FROM `+table+`
+			WHERE timestamp >= ? AND timestamp < ? AND aqi IS NOT NULL ORDER BY timestamp ASC`,
+			utcStart.Format(time.RFC3339), utcEnd.Format(time.RFC3339))
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		var times []time.Time
+		var values []float64
+		var sum float64
+		for rows.Next() {
+			var aqi float64
+			var timestampStr string
+			if err := rows.Scan(&aqi, &timestampStr); err != nil {
+				logf(r, "Row scan error: %v", err)
+				continue
+			}
+			timestamp, err := time.Parse(time.RFC3339, timestampStr)
+			if err != nil {
+				logf(r, "Timestamp parse error: %v", err)
+				continue
+			}
+			times = append(times, timestamp)
+			values = append(values, aqi)
+			sum += aqi
+		}
+		if err := rows.Err(); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		results := map[string]interface{}{
+			"start":           utcStart.Format(time.RFC3339),
+			"end":             utcEnd.Format(time.RFC3339),
+			"timezone":        localZone.String(),
+			"max_gap":         maxGap.String(),
+			"samples":         len(values),
+			"twa_aqi":         nil,
+			"mean_aqi":        nil,
+			"covered_seconds": 0,
+		}
+		if len(values) > 0 {
+			// The last reading counts until the day ends, or until now for today
+			end := utcEnd
+			if now := time.Now().UTC(); now.Before(end) {
+				end = now
+			}
+			if end.Before(times[len(times)-1]) {
+				end = times[len(times)-1]
+			}
+			results["mean_aqi"] = roundTo(sum/float64(len(values)), cfg.RoundDecimals)
+			if twa, covered, ok := timeWeightedMean(times, values, end, maxGap); ok {
+				results["twa_aqi"] = roundTo(twa, cfg.RoundDecimals)
+				results["twa_aqi_category"] = aqiCategory(int(math.Round(twa)))
+				results["covered_seconds"] = covered.Seconds()
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Compare aggregate statistics of two date ranges
+	http.HandleFunc("/tempstat/compare", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		percentiles, err := parsePercentiles(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var compare struct {
+			Current  DateRangeQuery `json:"current"`
+			Previous DateRangeQuery `json:"previous"`
+		}
+		if !decodeJSONBody(w, r, &compare, maxBodyBytes) {
+			return
+		}
+
+		// Both ranges include their end date, as in /tempdaterange; timestamps have second precision
+		sides := map[string]DateRangeQuery{"current": compare.Current, "previous": compare.Previous}
+		stats := map[string]map[string]interface{}{}
+		for name, q := range sides {
+			startDate, endDate, errs := parseDateRange(q)
+			if len(errs) > 0 {
+				for i := range errs {
+					errs[i].Field = name + "." + errs[i].Field
+				}
+				writeValidationErrors(w, errs)
+				return
+			}
+			result, err := queryStats(r.Context(), db, shards, rollup, startDate, endDate.Add(time.Second), r.URL.Query().Get("exclude_warmup") == "true", percentiles)
+			if err != nil {
+				if errors.Is(err, errTooManyShards) {
+					http.Error(w, fmt.Sprintf("%s: %v", name, err), http.StatusBadRequest)
+					return
+				}
+				writeDBError(w, r, err)
+				return
+			}
+			stats[name] = result
+		}
+
+		// Percentage change for every statistic present on both sides
+		changes := map[string]interface{}{}
+		for key, cur := range stats["current"] {
+			curVal, ok := toFloat(cur)
+			if !ok {
+				continue
+			}
+			prevVal, ok := toFloat(stats["previous"][key])
+			if !ok {
+				continue
+			}
+			changes[key] = percentChange(prevVal, curVal)
+		}
+		for _, result := range stats {
+			roundMetrics(result, cfg.RoundDecimals)
+		}
+
+		results := map[string]interface{}{
+			"current":        nil,
+			"previous":       nil,
+			"change_percent": changes,
+		}
+		for name, result := range stats {
+			if len(result) > 0 {
+				results[name] = result
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Classify the recent barometric pressure trend
+	http.HandleFunc("/pressure/trend", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		window := pressureTrendWindow
+		if v := r.URL.Query().Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid window %q (expected a duration such as 3h)", v), http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+
+		result, err := pressureTrend(r.Context(), db, shards, window)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		if result == nil {
+			http.Error(w, "Not enough pressure readings in the window", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	// API: Naively extrapolate each metric a number of minutes ahead
+	http.HandleFunc("/temp/project", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		minutes := 60
+		if v := q.Get("minutes"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1440 {
+				http.Error(w, fmt.Sprintf("Invalid minutes %q (expected an integer from 1 to 1440)", v), http.StatusBadRequest)
+				return
+			}
+			minutes = n
+		}
+		window := projectionWindow
+		if v := q.Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid window %q (expected a duration such as 2h)", v), http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+
+		result, err := projectReadings(r.Context(), db, shards, window, time.Duration(minutes)*time.Minute, cfg.RoundDecimals)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		if result == nil {
+			http.Error(w, "Not enough readings in the window", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	// API: Get daily data as CSV
+	http.HandleFunc("/tempget", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var dateQuery DateQuery
+		if !decodeJSONBody(w, r, &dateQuery, maxBodyBytes) {
+			return
+		}
+		if errs := dateQuery.validate(); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		csvOpts, err := parseCSVOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		csvOpts.Decimals = cfg.RoundDecimals
+
+		// Day bounds in the local timezone
+		localStart := startOfLocalDay(dateQuery.Year, time.Month(dateQuery.Month), dateQuery.Day, localZone)
+		localEnd := startOfLocalDay(dateQuery.Year, time.Month(dateQuery.Month), dateQuery.Day+1, localZone)
+		utcStart := localStart.UTC()
+		utcEnd := localEnd.UTC()
+
+		conn, table, release, err := shards.readConn(r.Context(), db, utcStart, utcEnd)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		if r.URL.Query().Get("exclude_warmup") == "true" {
+			table = withoutWarmup(table)
+		}
+
+		// Coverage metadata for the response headers, computed before streaming rows
+		var rowCount int
+		var firstTimestamp, lastTimestamp sql.NullString
+		err = conn.QueryRowContext(r.Context(), `SELECT COUNT(*), MIN(timestamp), MAX(timestamp) FROM `+table+` WHERE timestamp >= ? AND timestamp < ?`,
+			utcStart.Format(time.RFC3339), utcEnd.Format(time.RFC3339)).Scan(&rowCount, &firstTimestamp, &lastTimestamp)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		sqlStmt := `
+			SELECT ` + recordColumns + `
+			FROM ` + table + ` 
+			WHERE timestamp >= ? AND timestamp < ?
+			ORDER BY timestamp ASC`
+
+		rows, err := conn.QueryContext(r.Context(), sqlStmt, utcStart.Format(time.RFC3339), utcEnd.Format(time.RFC3339))
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		w.Header().Set("X-Row-Count", strconv.Itoa(rowCount))
+		if firstTimestamp.Valid {
+			w.Header().Set("X-First-Timestamp", firstTimestamp.String)
+			w.Header().Set("X-Last-Timestamp", lastTimestamp.String)
+		}
+		// The body is CSV, so the resolved window goes in headers
+		if r.URL.Query().Get("debug") == "true" {
+			w.Header().Set("X-Debug-UTC-Start", utcStart.Format(time.RFC3339))
+			w.Header().Set("X-Debug-UTC-End", utcEnd.Format(time.RFC3339))
+			w.Header().Set("X-Debug-Timezone", localZone.String())
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=weather_data.csv")
+
+		writeCSVRows(w, r, rows, csvOpts, localZone)
+	})
+
+	// API: Export a date range as CSV, streamed row by row
+	http.HandleFunc("/tempget/range", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var dateRange DateRangeQuery
+		if !decodeJSONBody(w, r, &dateRange, maxBodyBytes) {
+			return
+		}
+
+		startDate, endDate, errs := parseDateRange(dateRange)
+		if len(errs) == 0 {
+			errs = checkRangeSpan(startDate, endDate, maxStreamRangeDays)
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		csvOpts, err := parseCSVOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		csvOpts.Decimals = cfg.RoundDecimals
+
+		conn, table, release, err := shards.readConn(r.Context(), db, startDate, endDate)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		if r.URL.Query().Get("exclude_warmup") == "true" {
+			table = withoutWarmup(table)
+		}
+
+		// Both bounds inclusive, as in /tempdaterange
+		sqlStmt := `
+			SELECT ` + recordColumns + `
+			FROM ` + table + `
+			WHERE timestamp >= ? AND timestamp <= ?
+			ORDER BY timestamp ASC`
+
+		rows, err := conn.QueryContext(r.Context(), sqlStmt, startDate.Format(time.RFC3339), endDate.Format(time.RFC3339))
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		filename := fmt.Sprintf("weather_data_%s_%s.csv", startDate.In(localZone).Format("20060102"), endDate.In(localZone).Format("20060102"))
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+
+		n := writeCSVRows(w, r, rows, csvOpts, localZone)
+		logf(r, "Range CSV export wrote %d rows", n)
+	})
+
+	// API: Export a date range as a Parquet file, streamed in row groups
+	http.HandleFunc("/tempdaterange/parquet", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var dateRange DateRangeQuery
+		if !decodeJSONBody(w, r, &dateRange, maxBodyBytes) {
+			return
+		}
+
+		startDate, endDate, errs := parseDateRange(dateRange)
+		if len(errs) == 0 {
+			errs = checkRangeSpan(startDate, endDate, maxStreamRangeDays)
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		conn, table, release, err := shards.readConn(r.Context(), db, startDate, endDate)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		if r.URL.Query().Get("exclude_warmup") == "true" {
+			table = withoutWarmup(table)
+		}
+
+		// Both bounds inclusive, as in /tempdaterange
+		rows, err := conn.QueryContext(r.Context(), `SELECT `+recordColumns+` FROM `+table+`
+			WHERE timestamp >= ? AND timestamp <= ? ORDER BY timestamp ASC`,
+			startDate.Format(time.RFC3339), endDate.Format(time.RFC3339))
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		filename := fmt.Sprintf("weather_data_%s_%s.parquet", startDate.In(localZone).Format("20060102"), endDate.In(localZone).Format("20060102"))
+		w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+
+		// Once streaming has started a failure can only truncate the file,
+		// which readers reject because the footer is missing
+		n, err := writeParquetRows(w, r, rows)
+		if err != nil {
+			logf(r, "Parquet export failed after %d rows: %v", n, err)
+			return
+		}
+		logf(r, "Parquet export wrote %d rows", n)
+	})
+
+	// API: Get date range data
+	http.HandleFunc("/tempdaterange", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var dateRange DateRangeQuery
+		if !decodeJSONBody(w, r, &dateRange, maxBodyBytes) {
+			return
+		}
+
+		// Parse the input dates (expecting RFC3339 format)
+		startDate, endDate, errs := parseDateRange(dateRange)
+		filterConds, filterArgs, filterErrs := dateRange.valueFilters()
+		errs = append(errs, filterErrs...)
+		if len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		// Results are buffered in memory, so cap the span
+		if errs := checkRangeSpan(startDate, endDate, maxRangeDays); len(errs) > 0 {
+			errs[0].Message += " (use /tempget/range to export longer ranges)"
+			writeValidationErrors(w, errs)
+			return
+		}
+
+		fields, err := parseFields(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeFormat, err := parseTimeFormat(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		shape := r.URL.Query().Get("shape")
+		if shape != "" && shape != "array" && shape != "map" {
+			http.Error(w, fmt.Sprintf("Invalid shape %q (expected array or map)", shape), http.StatusBadRequest)
+			return
+		}
+		// Map keys are always RFC3339 and the readings drop their timestamp,
+		// so time_format has nothing to apply to
+		if shape == "map" {
+			timeFormat = "rfc3339"
+		}
+
+		if dateRange.Smooth < 0 {
+			http.Error(w, "smooth must be a non-negative window size", http.StatusBadRequest)
+			return
+		}
+
+		// Log the query parameters
+		logf(r, "Date range query: Start=%v (UTC), End=%v (UTC), Span=%.2f days",
+			startDate.Format(time.RFC3339),
+			endDate.Format(time.RFC3339),
+			endDate.Sub(startDate).Hours()/24)
+
+		conn, table, release, err := shards.readConn(r.Context(), db, startDate, endDate)
+		if err != nil {
+			if errors.Is(err, errTooManyShards) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeDBError(w, r, err)
+			return
+		}
+		defer release()
+		if r.URL.Query().Get("exclude_warmup") == "true" {
+			table = withoutWarmup(table)
+		}
+
+		// Query data for the specified date range
+		// Use >= and <= to include both start and end dates
+		columns := windRainColumns + `, warmup, note, altitude`
+		if storeDerived {
+			columns += `, ` + strings.Join(derivedColumns, ", ")
+		}
+		// Anomalies are flagged on every metric, so flagged requests read them all
+		selected := fields
+		if dateRange.FlagAnomalies {
+			selected = nil
+		}
+		where := strings.Join(append([]string{"timestamp >= ? AND timestamp <= ?"}, filterConds...), " AND ")
+		sqlStmt := `
+			SELECT ` + selectFields(recordColumns+`, `+columns, selected) + `
+			FROM ` + table + ` 
+			WHERE ` + where + `
+			ORDER BY timestamp ASC`
+
+		args := append([]interface{}{startDate.Format(time.RFC3339), endDate.Format(time.RFC3339)}, filterArgs...)
+		rows, err := conn.QueryContext(r.Context(), sqlStmt, args...)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		results := []map[string]interface{}{}
+		rowCount := 0
+		for rows.Next() {
+			var wr windRain
+			var warmup bool
+			var note sql.NullString
+			var altitude sql.NullFloat64
+			var dv derivedValues
+
+			extra := []interface{}{&wr.WindSpeed, &wr.WindDirection, &wr.Rainfall, &warmup, &note, &altitude}
+			if storeDerived {
+				extra = append(extra, &dv.DewPoint, &dv.AbsoluteHumidity)
+			}
+			rec, err := scanReading(rows, extra...)
+			if err != nil {
+				logf(r, "Row scan error: %v", err)
+				continue
+			}
+
+			result := rec.result()
+			wr.addTo(result)
+			dv.addTo(result)
+			if warmup {
+				result["warmup"] = true
+			}
+			if note.Valid && note.String != "" {
+				result["note"] = note.String
+			}
+			addSeaLevelPressure(result, rec.Temperature, rec.Pressure, altitude, cfg.RoundDecimals)
+
+			results = append(results, result)
+			rowCount++
+		}
+
+		if err = rows.Err(); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		logf(r, "Date range query returned %d rows", rowCount)
+		if rowCount > 0 {
+			firstTimestamp, _ := time.Parse(time.RFC3339, results[0]["timestamp"].(string))
+			lastTimestamp, _ := time.Parse(time.RFC3339, results[len(results)-1]["timestamp"].(string))
+			logf(r, "  First record: %v (UTC)", firstTimestamp.Format(time.RFC3339))
+			logf(r, "  Last record: %v (UTC)", lastTimestamp.Format(time.RFC3339))
+		}
+
+		if dateRange.FlagAnomalies {
+			threshold := dateRange.AnomalyThreshold
+			if threshold <= 0 {
+				threshold = anomalyStdDev
+			}
+			window := dateRange.AnomalyWindow
+			if window <= 0 {
+				window = anomalyWindow
+			}
+
+			// Detect on raw values, then smooth for display
+			flagAnomalies(results, window, threshold)
+			smoothReadings(results, dateRange.Smooth)
+			for _, result := range results {
+				roundMetrics(result, cfg.RoundDecimals)
+				filterFields(result, fields)
+				formatTimestamp(result, timeFormat)
+			}
+
+			if results == nil {
+				results = []map[string]interface{}{}
+			}
+			var data interface{} = results
+			if shape == "map" {
+				data = readingsByTimestamp(results)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": data,
+				"meta": map[string]interface{}{
+					"anomaly_threshold": threshold,
+					"anomaly_window":    window,
+				},
+			})
+			return
+		}
+
+		smoothReadings(results, dateRange.Smooth)
+		for _, result := range results {
+			roundMetrics(result, cfg.RoundDecimals)
+			filterFields(result, fields)
+			formatTimestamp(result, timeFormat)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if shape == "map" {
+			json.NewEncoder(w).Encode(readingsByTimestamp(results))
+			return
+		}
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Get the active calibration offsets
+	http.HandleFunc("/calibration", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(calibration)
+	})
+
+	// API: Get current gas resistance baseline (debugging)
+	http.HandleFunc("/baseline", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		value, updatedAt := baseline.get()
+		results := map[string]interface{}{
+			"window": baselineWindow.String(),
+		}
+		if value > 0 {
+			results["gas_resistance"] = value
+			results["updated_at"] = updatedAt.Format(time.RFC3339)
+		} else {
+			results["gas_resistance"] = nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Stream new readings as Server-Sent Events
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ch := broker.subscribe()
+		defer broker.unsubscribe(ch)
+		location, scoped := tenantLocation(r.Context())
+
+		// Heartbeat comments keep proxies from closing an idle connection
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-appCtx.Done():
+				return
+			case msg := <-ch:
+				if scoped && !eventAtLocation(msg, location) {
+					continue
+				}
+				fmt.Fprintf(w, "event: reading\ndata: %s\n\n", msg)
+				flusher.Flush()
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+				flusher.Flush()
+			}
+		}
+	})
+
+	// API: Download a consistent snapshot of the database (admin)
+	http.HandleFunc("/export/db", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if adminAPIKey == "" {
+			http.Error(w, "Admin endpoints are disabled (ADMIN_API_KEY not set)", http.StatusForbidden)
+			return
+		}
+		if !hasAPIKey(r, adminAPIKey) {
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		// In shard mode the readings live in one file per month, so a month
+		// must be picked; the main file only holds the other tables
+		source := db
+		if month := r.URL.Query().Get("month"); month != "" {
+			if shards == nil {
+				writeValidationErrors(w, []ValidationError{{Field: "month", Message: "month is only supported with SHARD_MODE=monthly"}})
+				return
+			}
+			m, err := time.Parse("2006-01", month)
+			if err != nil {
+				writeValidationErrors(w, []ValidationError{{Field: "month", Message: "month must be formatted as YYYY-MM"}})
+				return
+			}
+			_, file := shards.name(m)
+			if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+				http.Error(w, fmt.Sprintf("No shard for %s", month), http.StatusNotFound)
+				return
+			}
+			if source, err = shards.open(file); err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+		}
+
+		// VACUUM INTO needs a path that doesn't exist yet
+		tmpDir, err := os.MkdirTemp("", "temprec-export-")
+		if err != nil {
+			logf(r, "Export error: %v", err)
+			http.Error(w, fmt.Sprintf("Export error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(tmpDir)
+
+		snapshot := filepath.Join(tmpDir, "snapshot.db")
+		if _, err := source.ExecContext(r.Context(), `VACUUM INTO ?`, snapshot); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		f, err := os.Open(snapshot)
+		if err != nil {
+			logf(r, "Export error: %v", err)
+			http.Error(w, fmt.Sprintf("Export error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		filename := fmt.Sprintf("weather_backup_%s.db", time.Now().UTC().Format("20060102_150405"))
+		w.Header().Set("Content-Type", "application/vnd.sqlite3")
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+		if info, err := f.Stat(); err == nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			logf(r, "Export stream error: %v", err)
+			return
+		}
+		logf(r, "Database snapshot exported as %s", filename)
+	})
+
+	// API: Server uptime and data freshness for status pages
+	http.HandleFunc("/temp/uptime", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var total int
+		var newest sql.NullString
+		err := shards.each(db, false, func(db *sql.DB, _ time.Time) (bool, error) {
+			var count int
+			var last sql.NullString
+			if err := db.QueryRowContext(r.Context(), `SELECT COUNT(*), MAX(timestamp) FROM `+scopeTable(r.Context(), "temp")).Scan(&count, &last); err != nil {
+				return false, err
+			}
+			total += count
+			if last.Valid && (!newest.Valid || last.String > newest.String) {
+				newest = last
+			}
+			return true, nil
+		})
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		uptime := time.Since(startTime)
+		results := map[string]interface{}{
+			"started_at":                 startTime.UTC().Format(time.RFC3339),
+			"uptime":                     uptime.Truncate(time.Second).String(),
+			"uptime_seconds":             int64(uptime.Seconds()),
+			"total_readings":             total,
+			"newest_reading":             nil,
+			"newest_reading_age_seconds": nil,
+			"port":                       port,
+			"version":                    version,
+		}
+		if newest.Valid {
+			results["newest_reading"] = newest.String
+			if ts, err := time.Parse(time.RFC3339, newest.String); err == nil {
+				results["newest_reading_age_seconds"] = int64(time.Since(ts).Seconds())
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Database size and row counts for capacity planning (admin only)
+	http.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if adminAPIKey == "" {
+			http.Error(w, "Admin endpoints are disabled (ADMIN_API_KEY not set)", http.StatusForbidden)
+			return
+		}
+		if !hasAPIKey(r, adminAPIKey) {
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		since := time.Now().UTC().Add(-24 * time.Hour).Format(time.RFC3339)
+		sqlStmt := `SELECT COUNT(*),
+			COUNT(CASE WHEN timestamp >= ? THEN 1 END),
+			MIN(timestamp), MAX(timestamp)
+			FROM temp`
+
+		// Distinct locations are merged in Go since a location can span shards
+		var total, last24h int
+		var earliest, latest sql.NullString
+		locations := map[string]bool{}
+		err := shards.each(db, true, func(db *sql.DB, _ time.Time) (bool, error) {
+			var count, recent int
+			var first, last sql.NullString
+			if err := db.QueryRowContext(r.Context(), sqlStmt, since).Scan(&count, &recent, &first, &last); err != nil {
+				return false, err
+			}
+			total += count
+			last24h += recent
+			if first.Valid && (!earliest.Valid || first.String < earliest.String) {
+				earliest = first
+			}
+			if last.Valid && (!latest.Valid || last.String > latest.String) {
+				latest = last
+			}
+
+			rows, err := db.QueryContext(r.Context(), `SELECT DISTINCT location FROM temp WHERE location IS NOT NULL`)
+			if err != nil {
+				return false, err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var location string
+				if err := rows.Scan(&location); err != nil {
+					return false, err
+				}
+				locations[location] = true
+			}
+			return true, rows.Err()
+		})
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		results := map[string]interface{}{
+			"total_rows":         total,
+			"rows_last_24h":      last24h,
+			"distinct_locations": len(locations),
+			"earliest":           nil,
+			"latest":             nil,
+		}
+		if earliest.Valid {
+			results["earliest"] = earliest.String
+			results["latest"] = latest.String
+		}
+		if shards != nil {
+			files, err := shards.files()
+			if err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+			var size int64
+			for _, file := range files {
+				if info, err := os.Stat(file); err == nil {
+					size += info.Size()
+				}
+			}
+			results["shard_count"] = len(files)
+			results["shard_size_bytes"] = size
+		}
+
+		// Recent writes may still sit in the WAL, so report it alongside the main file
+		if info, err := os.Stat(cfg.DBPath); err == nil {
+			results["file_size_bytes"] = info.Size()
+		}
+		if info, err := os.Stat(cfg.DBPath + "-wal"); err == nil {
+			results["wal_size_bytes"] = info.Size()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Report the WAL size (GET) or checkpoint and truncate the WAL (POST)
+	http.HandleFunc("/admin/checkpoint", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if adminAPIKey == "" {
+			http.Error(w, "Admin endpoints are disabled (ADMIN_API_KEY not set)", http.StatusForbidden)
+			return
+		}
+		if !hasAPIKey(r, adminAPIKey) {
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+
+		walSize := func() int64 {
+			if info, err := os.Stat(cfg.DBPath + "-wal"); err == nil {
+				return info.Size()
+			}
+			return 0
+		}
+
+		var journalMode string
+		if err := db.QueryRowContext(r.Context(), `PRAGMA journal_mode`).Scan(&journalMode); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		results := map[string]interface{}{
+			"journal_mode":   journalMode,
+			"wal_size_bytes": walSize(),
+		}
+
+		if r.Method == http.MethodPost {
+			if journalMode != "wal" {
+				http.Error(w, fmt.Sprintf("journal_mode is %s; checkpoints need wal", journalMode), http.StatusConflict)
+				return
+			}
+			// busy is 1 when readers or writers kept the checkpoint from
+			// finishing; log and checkpointed count WAL frames
+			var busy, logFrames, checkpointed int
+			if err := db.QueryRowContext(r.Context(), `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logFrames, &checkpointed); err != nil {
+				writeDBError(w, r, err)
+				return
+			}
+			logf(r, "WAL checkpoint: busy=%d log=%d checkpointed=%d", busy, logFrames, checkpointed)
+			results["wal_size_bytes_before"] = results["wal_size_bytes"]
+			results["wal_size_bytes"] = walSize()
+			results["busy"] = busy == 1
+			results["log_frames"] = logFrames
+			results["checkpointed_frames"] = checkpointed
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	// API: Request counts per endpoint from the api_access table (admin)
+	http.HandleFunc("/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if adminAPIKey == "" {
+			http.Error(w, "Admin endpoints are disabled (ADMIN_API_KEY not set)", http.StatusForbidden)
+			return
+		}
+		if !hasAPIKey(r, adminAPIKey) {
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+		if access == nil {
+			http.Error(w, "Access logging is disabled (ACCESS_LOG not set)", http.StatusNotFound)
+			return
+		}
+
+		// Defaults to the last 24 hours
+		q := r.URL.Query()
+		endDate := time.Now().UTC()
+		startDate := endDate.Add(-24 * time.Hour)
+		if q.Has("startDate") || q.Has("endDate") {
+			var errs []ValidationError
+			startDate, endDate, errs = parseDateRange(DateRangeQuery{StartDate: q.Get("startDate"), EndDate: q.Get("endDate")})
+			if len(errs) > 0 {
+				writeValidationErrors(w, errs)
+				return
+			}
+		}
+
+		rows, err := db.QueryContext(r.Context(), `SELECT endpoint, COUNT(*),
+			COUNT(CASE WHEN status >= 400 THEN 1 END), AVG(duration_ms), MAX(duration_ms)
+			FROM api_access WHERE timestamp >= ? AND timestamp <= ?
+			GROUP BY endpoint ORDER BY COUNT(*) DESC, endpoint`,
+			startDate.Format(time.RFC3339), endDate.Format(time.RFC3339))
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		defer rows.Close()
+
+		endpoints := []map[string]interface{}{}
+		total := 0
+		for rows.Next() {
+			var endpoint string
+			var requests, failed int
+			var avgMs, maxMs float64
+			if err := rows.Scan(&endpoint, &requests, &failed, &avgMs, &maxMs); err != nil {
+				logf(r, "Row scan error: %v", err)
+				continue
+			}
+			endpoints = append(endpoints, map[string]interface{}{
+				"endpoint":        endpoint,
+				"requests":        requests,
+				"errors":          failed,
+				"avg_duration_ms": roundTo(avgMs, 2),
+				"max_duration_ms": roundTo(maxMs, 2),
+			})
+			total += requests
+		}
+		if err := rows.Err(); err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"start":        startDate.Format(time.RFC3339),
+			"end":          endDate.Format(time.RFC3339),
+			"sample_every": access.every,
+			"dropped":      access.dropped.Load(),
+			"total":        total,
+			"endpoints":    endpoints,
+		})
+	})
+
+	// API: OpenAPI description of this service
+	http.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPISpec)
+	})
+
+	// Schema and state are in place; stop answering 503
+	ready.Store(true)
+	log.Println("Startup complete, accepting requests")
+
+	err = <-serveErr
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	log.Println("Server stopped")
+}
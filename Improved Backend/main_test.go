@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/parquet-go/parquet-go"
+)
+
+// openTestDB returns an empty in-memory database with the temp table. One
+// connection is kept so every query sees the same database.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(createTableSQL); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestWriteParquetRowsRoundTrip(t *testing.T) {
+	db := openTestDB(t)
+
+	// Enough rows for three row groups; every third has no gas resistance
+	// and every fifth no AQI
+	const n = 2*parquetRowGroupRows + 500
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		var gas, aqi interface{}
+		if i%3 != 0 {
+			gas = 50000 + i
+		}
+		if i%5 != 0 {
+			aqi = i % 500
+		}
+		if _, err := tx.Exec(`INSERT INTO temp (temperature, humidity, pressure, gas_resistance, aqi, timestamp) VALUES (?, ?, ?, ?, ?, ?)`,
+			20+float64(i)/100, 40.5, 1013.25, gas, aqi, start.Add(time.Duration(i)*time.Minute).Format(time.RFC3339)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(`SELECT ` + recordColumns + ` FROM temp ORDER BY timestamp ASC`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var buf bytes.Buffer
+	written, err := writeParquetRows(&buf, httptest.NewRequest("POST", "/tempdaterange/parquet", nil), rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != n {
+		t.Fatalf("wrote %d rows, want %d", written, n)
+	}
+
+	f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups := len(f.RowGroups()); groups != 3 {
+		t.Errorf("got %d row groups, want 3", groups)
+	}
+
+	got, err := parquet.Read[parquetReading](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n {
+		t.Fatalf("read %d rows, want %d", len(got), n)
+	}
+	for i, row := range got {
+		if want := start.Add(time.Duration(i) * time.Minute); !row.Timestamp.Equal(want) {
+			t.Fatalf("row %d: timestamp %v, want %v", i, row.Timestamp, want)
+		}
+		if want := 20 + float64(i)/100; row.Temperature != want || row.Humidity != 40.5 || row.Pressure != 1013.25 {
+			t.Fatalf("row %d: metrics %v/%v/%v, want %v/40.5/1013.25", i, row.Temperature, row.Humidity, row.Pressure, want)
+		}
+		switch {
+		case i%3 == 0 && row.GasResistance != nil:
+			t.Fatalf("row %d: gas_resistance %d, want null", i, *row.GasResistance)
+		case i%3 != 0 && (row.GasResistance == nil || *row.GasResistance != int64(50000+i)):
+			t.Fatalf("row %d: gas_resistance %v, want %d", i, row.GasResistance, 50000+i)
+		}
+		switch {
+		case i%5 == 0 && row.AQI != nil:
+			t.Fatalf("row %d: aqi %d, want null", i, *row.AQI)
+		case i%5 != 0 && (row.AQI == nil || *row.AQI != int64(i%500)):
+			t.Fatalf("row %d: aqi %v, want %d", i, row.AQI, i%500)
+		}
+	}
+}
+
+// insertTestReading stores a reading at ts with humidity 50 and pressure
+// 1000; nil gas or aqi are stored as NULL
+func insertTestReading(t *testing.T, db *sql.DB, ts time.Time, temperature float64, gas, aqi interface{}) {
+	t.Helper()
+	if _, err := db.Exec(`INSERT INTO temp (temperature, humidity, pressure, gas_resistance, aqi, timestamp) VALUES (?, 50, 1000, ?, ?, ?)`,
+		temperature, gas, aqi, ts.UTC().Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec(createHourlySummarySQL); err != nil {
+		t.Fatal(err)
+	}
+	writes := newWriteQueue(8, insertSQL(insertColumns))
+	go writes.run()
+	defer close(writes.jobs)
+
+	// The first hour has no gas resistance or AQI at all; the third mixes
+	// NULLs with values
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	insertTestReading(t, db, day.Add(10*time.Minute), 10, nil, nil)
+	insertTestReading(t, db, day.Add(40*time.Minute), 12, nil, nil)
+	insertTestReading(t, db, day.Add(2*time.Hour+10*time.Minute), 20, 100, 50)
+	insertTestReading(t, db, day.Add(2*time.Hour+20*time.Minute), 22, nil, nil)
+	insertTestReading(t, db, day.Add(2*time.Hour+40*time.Minute), 24, 200, 150)
+
+	rollup := &hourlyRollup{db: db, writes: writes, enabled: true}
+	ctx := context.Background()
+	if err := rollup.recompute(ctx, day, day.Add(3*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	rollup.upTo.Store(day.Add(3 * time.Hour).Unix())
+
+	metrics := func(maxTemp, minTemp, avgTemp float64) map[string]interface{} {
+		return map[string]interface{}{
+			"max_temperature": maxTemp, "min_temperature": minTemp, "avg_temperature": avgTemp,
+			"max_humidity": 50.0, "min_humidity": 50.0, "avg_humidity": 50.0,
+			"max_pressure": 1000.0, "min_pressure": 1000.0, "avg_pressure": 1000.0,
+		}
+	}
+	withGasAndAQI := func(results map[string]interface{}) map[string]interface{} {
+		results["max_gas_resistance"] = int64(200)
+		results["min_gas_resistance"] = int64(100)
+		results["avg_gas_resistance"] = 150.0
+		results["max_aqi"] = int64(150)
+		results["min_aqi"] = int64(50)
+		results["avg_aqi"] = 100.0
+		results["aqi_category"] = aqiCategory(100)
+		return results
+	}
+
+	tests := []struct {
+		name        string
+		rollup      *hourlyRollup
+		start, end  time.Time
+		setup       func(t *testing.T)
+		percentiles []float64
+		want        map[string]interface{}
+	}{
+		{
+			name:  "all null gas and aqi",
+			start: day, end: day.Add(time.Hour),
+			want: metrics(12, 10, 11),
+		},
+		{
+			name:  "mixed gas and aqi",
+			start: day.Add(2 * time.Hour), end: day.Add(3 * time.Hour),
+			want: withGasAndAQI(metrics(24, 20, 22)),
+		},
+		{
+			name:  "percentiles",
+			start: day.Add(2 * time.Hour), end: day.Add(3 * time.Hour),
+			percentiles: []float64{25, 50},
+			want: func() map[string]interface{} {
+				results := withGasAndAQI(metrics(24, 20, 22))
+				for metric, p := range map[string][2]float64{
+					"temperature": {21, 22}, "humidity": {50, 50}, "pressure": {1000, 1000},
+					"gas_resistance": {125, 150}, "aqi": {75, 100},
+				} {
+					results["p25_"+metric], results["p50_"+metric] = p[0], p[1]
+				}
+				return results
+			}(),
+		},
+		{
+			// 00:30-01:00 from the readings, 01:00-03:00 from hourly_summary
+			name:   "hourly summary",
+			rollup: rollup,
+			start:  day.Add(30 * time.Minute), end: day.Add(3 * time.Hour),
+			// Deleting a reading without touching its hour leaves it in
+			// hourly_summary, so max_temperature shows the summary was read
+			setup: func(t *testing.T) {
+				if _, err := db.Exec(`DELETE FROM temp WHERE temperature = 24`); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: withGasAndAQI(metrics(24, 12, 19.5)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+			rollup := tt.rollup
+			if rollup == nil {
+				rollup = &hourlyRollup{db: db, writes: writes}
+			}
+			got, err := queryStats(ctx, db, nil, rollup, tt.start, tt.end, false, tt.percentiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("queryStats() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanReading(t *testing.T) {
+	db := openTestDB(t)
+	intPtr := func(v int) *int { return &v }
+	ts := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		gas, aqi   interface{}
+		timestamp  string
+		wantGas    *int
+		wantAQI    *int
+		wantErr    bool
+		withExtras bool
+	}{
+		{name: "gas and aqi", gas: 120000, aqi: 42, timestamp: ts.Format(time.RFC3339), wantGas: intPtr(120000), wantAQI: intPtr(42)},
+		{name: "null gas and aqi", timestamp: ts.Format(time.RFC3339)},
+		{name: "null gas only", aqi: 7, timestamp: ts.Format(time.RFC3339), wantAQI: intPtr(7)},
+		{name: "bad timestamp", gas: 1, aqi: 1, timestamp: "2024-03-01 12:30", wantErr: true},
+		{name: "extra columns", gas: 5, timestamp: ts.Format(time.RFC3339), wantGas: intPtr(5), withExtras: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := `SELECT 21.5, 40.25, 1013.0, ?, ?, ?`
+			var location string
+			var id int
+			var extra []interface{}
+			if tt.withExtras {
+				query += `, 'garden', 17`
+				extra = []interface{}{&location, &id}
+			}
+
+			rec, err := scanReading(db.QueryRow(query, tt.gas, tt.aqi, tt.timestamp), extra...)
+			if tt.wantErr {
+				var parseErr *time.ParseError
+				if !errors.As(err, &parseErr) || !strings.Contains(err.Error(), tt.timestamp) {
+					t.Fatalf("scanReading() error = %v, want a wrapped *time.ParseError naming %q", err, tt.timestamp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rec.Temperature != 21.5 || rec.Humidity != 40.25 || rec.Pressure != 1013 {
+				t.Errorf("metrics = %v/%v/%v, want 21.5/40.25/1013", rec.Temperature, rec.Humidity, rec.Pressure)
+			}
+			if !rec.Timestamp.Equal(ts) {
+				t.Errorf("Timestamp = %v, want %v", rec.Timestamp, ts)
+			}
+			if !reflect.DeepEqual(rec.GasResistance, tt.wantGas) {
+				t.Errorf("GasResistance = %v, want %v", rec.GasResistance, tt.wantGas)
+			}
+			if !reflect.DeepEqual(rec.AQI, tt.wantAQI) {
+				t.Errorf("AQI = %v, want %v", rec.AQI, tt.wantAQI)
+			}
+			if tt.withExtras && (location != "garden" || id != 17) {
+				t.Errorf("extra = %q, %d, want \"garden\", 17", location, id)
+			}
+		})
+	}
+}
+
+func TestLatestValidators(t *testing.T) {
+	reading := DatabaseRecord{Temperature: 21.5, Humidity: 40, Pressure: 1013, Timestamp: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)}.result()
+	etag, modified := latestValidators(reading)
+	if !modified.Equal(time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("modified = %v, want the reading's timestamp", modified)
+	}
+	if again, _ := latestValidators(maps.Clone(reading)); again != etag {
+		t.Errorf("ETag changed for the same reading: %s, then %s", etag, again)
+	}
+	edited := maps.Clone(reading)
+	edited["temperature"] = 22.0
+	editedTag, _ := latestValidators(edited)
+	if editedTag == etag {
+		t.Error("ETag unchanged after the reading was edited")
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{name: "no validators", want: false},
+		{name: "matching etag", headers: map[string]string{"If-None-Match": etag}, want: true},
+		{name: "weak etag in list", headers: map[string]string{"If-None-Match": `"other", W/` + etag}, want: true},
+		{name: "edited reading", headers: map[string]string{"If-None-Match": editedTag}, want: false},
+		{name: "wildcard", headers: map[string]string{"If-None-Match": "*"}, want: true},
+		{name: "modified since", headers: map[string]string{"If-Modified-Since": modified.Add(-time.Minute).Format(http.TimeFormat)}, want: false},
+		{name: "not modified since", headers: map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, want: true},
+		{
+			name:    "etag takes precedence",
+			headers: map[string]string{"If-None-Match": editedTag, "If-Modified-Since": modified.Format(http.TimeFormat)},
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/temp", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := notModified(r, etag, modified); got != tt.want {
+				t.Errorf("notModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardIDs(t *testing.T) {
+	dir := t.TempDir()
+	shards := newShardStore(filepath.Join(dir, "data.db"))
+	defer shards.close()
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	april := march.AddDate(0, 1, 0)
+
+	// A March shard written before ids were unique, numbered from 1
+	_, legacyFile := shards.name(march)
+	legacy, err := sql.Open("sqlite3", legacyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := legacy.Exec(createTableSQL); err != nil {
+		t.Fatal(err)
+	}
+	insertTestReading(t, legacy, march.Add(time.Hour), 10, nil, nil)
+	insertTestReading(t, legacy, march.Add(2*time.Hour), 11, nil, nil)
+	legacy.Close()
+	if err := shards.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	// Migrating again must not move them twice
+	if err := shards.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	marchDB, err := shards.writeDB(nil, march.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertTestReading(t, marchDB, march.Add(3*time.Hour), 12, nil, nil)
+	aprilDB, err := shards.writeDB(nil, april.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertTestReading(t, aprilDB, april.Add(time.Hour), 20, nil, nil)
+
+	ids := map[int64]float64{}
+	for _, db := range []*sql.DB{marchDB, aprilDB} {
+		rows, err := db.Query(`SELECT id, temperature FROM temp`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var id int64
+			var temperature float64
+			if err := rows.Scan(&id, &temperature); err != nil {
+				t.Fatal(err)
+			}
+			ids[id] = temperature
+		}
+		rows.Close()
+	}
+	marchBase, aprilBase := shardIDBase(march), shardIDBase(april)
+	want := map[int64]float64{marchBase + 1: 10, marchBase + 2: 11, marchBase + 3: 12, aprilBase + 1: 20}
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+
+	for id, temperature := range want {
+		db, err := shards.byID(nil, id)
+		if err != nil {
+			t.Fatalf("byID(%d): %v", id, err)
+		}
+		var got float64
+		if err := db.QueryRow(`SELECT temperature FROM temp WHERE id = ?`, id).Scan(&got); err != nil || got != temperature {
+			t.Errorf("byID(%d) found %v, %v; want %v", id, got, err, temperature)
+		}
+	}
+	// Ids of a month without a shard, and ids from 1 as earlier versions
+	// used, match nothing
+	for _, id := range []int64{shardIDBase(march.AddDate(0, 2, 0)) + 1, 1, 0, -1} {
+		if _, err := shards.byID(nil, id); err != sql.ErrNoRows {
+			t.Errorf("byID(%d) error = %v, want sql.ErrNoRows", id, err)
+		}
+	}
+
+	// A range read across both shards sees every id once
+	mainDB := openTestDB(t)
+	conn, table, release, err := shards.readConn(context.Background(), mainDB, march, april.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	var count, distinct int
+	if err := conn.QueryRowContext(context.Background(), `SELECT COUNT(*), COUNT(DISTINCT id) FROM `+table).Scan(&count, &distinct); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || distinct != 4 {
+		t.Errorf("range read %d readings with %d distinct ids, want 4 and 4", count, distinct)
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	store := newIdempotencyStore(time.Hour)
+	inserts := 0
+	handler := store.wrap(func(w http.ResponseWriter, r *http.Request) {
+		inserts++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"insert":%d}`, inserts)
+	})
+	post := func(apiKey, idempotencyKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/temprec", strings.NewReader(`{}`))
+		if apiKey != "" {
+			r.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		r.Header.Set("Idempotency-Key", idempotencyKey)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name, apiKey, key string
+		wantBody          string
+		wantReplayed      bool
+	}{
+		{name: "first request", apiKey: "tenant-a", key: "k1", wantBody: `{"insert":1}`},
+		{name: "repeat", apiKey: "tenant-a", key: "k1", wantBody: `{"insert":1}`, wantReplayed: true},
+		{name: "other tenant, same key", apiKey: "tenant-b", key: "k1", wantBody: `{"insert":2}`},
+		{name: "other tenant repeats", apiKey: "tenant-b", key: "k1", wantBody: `{"insert":2}`, wantReplayed: true},
+		{name: "no api key, same key", key: "k1", wantBody: `{"insert":3}`},
+		{name: "new key", apiKey: "tenant-a", key: "k2", wantBody: `{"insert":4}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := post(tt.apiKey, tt.key)
+			if w.Code != http.StatusCreated || w.Body.String() != tt.wantBody {
+				t.Errorf("got %d %s, want 201 %s", w.Code, w.Body, tt.wantBody)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+				t.Errorf("replayed = %v, want %v", replayed, tt.wantReplayed)
+			}
+		})
+	}
+}
+
+func TestLoadTimezone(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: "IST"},
+		{name: "named zone", cfg: Config{Timezone: "Europe/London"}, want: "Europe/London"},
+		{name: "offset wins", cfg: Config{Timezone: "Europe/London", TZOffsetMinutes: intPtr(-330)}, want: "UTC-05:30"},
+		{name: "unknown zone", cfg: Config{Timezone: "Mars/Base"}, wantErr: true},
+		{name: "offset out of range", cfg: Config{TZOffsetMinutes: intPtr(15 * 60)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := loadTimezone(tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadTimezone() = %v, want an error", loc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loc.String() != tt.want {
+				t.Errorf("loadTimezone() = %v, want %v", loc, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartOfLocalDay(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	havana, err := time.LoadLocation("America/Havana")
+	if err != nil {
+		t.Skip(err)
+	}
+	utc := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name       string
+		loc        *time.Location
+		year       int
+		month      time.Month
+		startDay   int
+		endDay     int
+		wantStart  string
+		wantLength time.Duration
+	}{
+		{name: "month with spring forward", loc: london, year: 2024, month: time.March, startDay: 1, endDay: 32, wantStart: "2024-03-01T00:00:00Z", wantLength: 743 * time.Hour},
+		{name: "month with fall back", loc: london, year: 2024, month: time.October, startDay: 1, endDay: 32, wantStart: "2024-09-30T23:00:00Z", wantLength: 745 * time.Hour},
+		{name: "midnight skipped", loc: havana, year: 2024, month: time.March, startDay: 10, endDay: 11, wantStart: "2024-03-10T05:00:00Z", wantLength: 23 * time.Hour},
+		{name: "midnight repeated", loc: havana, year: 2024, month: time.November, startDay: 3, endDay: 4, wantStart: "2024-11-03T04:00:00Z", wantLength: 25 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := startOfLocalDay(tt.year, tt.month, tt.startDay, tt.loc)
+			end := startOfLocalDay(tt.year, tt.month, tt.endDay, tt.loc)
+			if !start.Equal(utc(tt.wantStart)) {
+				t.Errorf("start = %v, want %v", start.UTC(), tt.wantStart)
+			}
+			if got := end.Sub(start); got != tt.wantLength {
+				t.Errorf("length = %v, want %v", got, tt.wantLength)
+			}
+		})
+	}
+}
+
+func TestLocalDayBounds(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+	utc := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name      string
+		now       string
+		daysAgo   int
+		wantStart string
+		wantEnd   string
+	}{
+		{name: "today is short", now: "2024-03-31T12:00:00Z", wantStart: "2024-03-31T00:00:00Z", wantEnd: "2024-03-31T23:00:00Z"},
+		{name: "yesterday before spring forward", now: "2024-03-31T12:00:00Z", daysAgo: 1, wantStart: "2024-03-30T00:00:00Z", wantEnd: "2024-03-31T00:00:00Z"},
+		{name: "yesterday is long", now: "2024-10-28T00:30:00Z", daysAgo: 1, wantStart: "2024-10-26T23:00:00Z", wantEnd: "2024-10-28T00:00:00Z"},
+		{name: "local date ahead of UTC", now: "2024-04-30T23:30:00Z", wantStart: "2024-04-30T23:00:00Z", wantEnd: "2024-05-01T23:00:00Z"},
+		{name: "yesterday in previous month", now: "2024-04-01T09:00:00Z", daysAgo: 1, wantStart: "2024-03-31T00:00:00Z", wantEnd: "2024-03-31T23:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := localDayBounds(utc(tt.now), tt.daysAgo, london)
+			if !start.Equal(utc(tt.wantStart)) || !end.Equal(utc(tt.wantEnd)) {
+				t.Errorf("localDayBounds() = %v, %v, want %v, %v", start.UTC(), end.UTC(), tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	const columns = recordColumns + `, location, altitude`
+	tests := []struct {
+		name   string
+		fields map[string]bool
+		want   string
+	}{
+		{name: "every field", want: columns},
+		{
+			name:   "aqi only",
+			fields: map[string]bool{"aqi": true},
+			want:   `0 AS temperature, 0 AS humidity, 0 AS pressure, NULL AS gas_resistance, aqi, timestamp, location, NULL AS altitude`,
+		},
+		{
+			name:   "derived fields keep their inputs",
+			fields: map[string]bool{"sea_level_pressure": true},
+			want:   `temperature, 0 AS humidity, pressure, NULL AS gas_resistance, NULL AS aqi, timestamp, location, altitude`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectFields(columns, tt.fields); got != tt.want {
+				t.Errorf("selectFields() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// registerTenantDriver registers a driver whose connections have the
+// tenant_location function, as main does for sqlite3_app
+var registerTenantDriver sync.Once
+
+func TestTenantScoping(t *testing.T) {
+	registerTenantDriver.Do(func() {
+		sql.Register("sqlite3_tenant_test", &sqlite3.SQLiteDriver{ConnectHook: registerSQLFunctions})
+	})
+	auth := newTenantAuth(map[string]string{"key-a": "O'Brien's garden", "key-b": "roof"}, "admin-key", "")
+	saved := tenantLocations
+	tenantLocations = auth.locations
+	t.Cleanup(func() { tenantLocations = saved })
+
+	db, err := sql.Open("sqlite3_tenant_test", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(createTableSQL); err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range []interface{}{"O'Brien's garden", "O'Brien's garden", "roof", nil} {
+		if _, err := db.Exec(`INSERT INTO temp (temperature, humidity, pressure, location) VALUES (20, 50, 1000, ?)`, location); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := auth.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		table := scopeTable(r.Context(), "temp")
+		if strings.Contains(table, "Brien") || strings.Contains(table, "roof") {
+			t.Errorf("location appears in the SQL text: %s", table)
+		}
+		var count int
+		var locations sql.NullString
+		if err := db.QueryRowContext(r.Context(), `SELECT COUNT(*), GROUP_CONCAT(DISTINCT location) FROM `+table).Scan(&count, &locations); err != nil {
+			t.Error(err)
+		}
+		fmt.Fprintf(w, "%d %s write=%v", count, locations.String, canWrite(r, "write-key"))
+	}))
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		wantCode int
+		wantBody string
+	}{
+		{name: "tenant with a quote in its location", headers: map[string]string{"Authorization": "Bearer key-a"}, wantCode: 200, wantBody: "2 O'Brien's garden write=true"},
+		{name: "tenant via X-API-Key", headers: map[string]string{"X-API-Key": "key-b"}, wantCode: 200, wantBody: "1 roof write=true"},
+		{name: "operator sees every location", headers: map[string]string{"X-API-Key": "admin-key"}, wantCode: 200, wantBody: "4 O'Brien's garden,roof write=false"},
+		{name: "key without Bearer prefix", headers: map[string]string{"Authorization": "key-a"}, wantCode: 401},
+		{name: "other scheme", headers: map[string]string{"Authorization": "Token key-a"}, wantCode: 401},
+		{name: "unknown key", headers: map[string]string{"X-API-Key": "key-c"}, wantCode: 401},
+		{name: "no key", wantCode: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/temp", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestReadingPatchValidate(t *testing.T) {
+	ranges := defaultConfig().Validation
+	float := func(v float64) *float64 { return &v }
+	integer := func(v int) *int { return &v }
+
+	tests := []struct {
+		name       string
+		patch      ReadingPatch
+		wantFields []string
+	}{
+		{name: "empty patch", patch: ReadingPatch{}},
+		{name: "valid fields", patch: ReadingPatch{Temperature: float(21.5), AQI: integer(500), GasResistance: integer(0)}},
+		{name: "aqi above the scale", patch: ReadingPatch{AQI: integer(501)}, wantFields: []string{"aqi"}},
+		{name: "negative aqi", patch: ReadingPatch{AQI: integer(-1)}, wantFields: []string{"aqi"}},
+		{
+			name:       "every failure is reported",
+			patch:      ReadingPatch{Temperature: float(150), Humidity: float(-1), Pressure: float(50), GasResistance: integer(-5), AQI: integer(900)},
+			wantFields: []string{"temperature", "humidity", "pressure", "gas_resistance", "aqi"},
+		},
+		{name: "only present fields are checked", patch: ReadingPatch{Humidity: float(101)}, wantFields: []string{"humidity"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+			for _, e := range tt.patch.validate(ranges) {
+				fields = append(fields, e.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("validate() failed fields %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}